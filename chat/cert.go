@@ -0,0 +1,145 @@
+package chat
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Names of files in config directory where
+	// TLS certificate and its private key are kept.
+	certFileName    = "tls.crt"
+	certKeyFileName = "tls.key"
+
+	// Certificate is self-signed and pinned by users,
+	// so there is no reason to rotate it.
+	certValidity = time.Hour * 24 * 365 * 100
+)
+
+// loadCertificate reads TLS certificate from dir.
+//
+// If dir doesn't have certificate, then new self-signed
+// one will be generated and saved. Only current OS user
+// is allowed to read saved private key.
+func loadCertificate(dir string) (tls.Certificate, error) {
+	certPath := filepath.Join(dir, certFileName)
+	keyPath := filepath.Join(dir, certKeyFileName)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return cert, err
+	}
+
+	certPEM, keyPEM, err := generateCertificate()
+
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if err := os.WriteFile(certPath, certPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// generateCertificate returns PEM encoded self-signed
+// certificate and its private key.
+func generateCertificate() (certPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "terminal-chat"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, keyPEM, nil
+}
+
+// certificatePin is a fingerprint of TLS certificate that
+// user presented first time (trust on first use).
+//
+// It is set asynchronously, so it is shared between
+// copies of userInfo. Methods are safe for nil pin.
+type certificatePin struct {
+	mu          sync.Mutex
+	fingerprint []byte
+}
+
+// get returns pinned fingerprint, nil if nothing is pinned yet.
+func (p *certificatePin) get() []byte {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.fingerprint
+}
+
+// pin remembers fingerprint if nothing is pinned yet.
+// It returns fingerprint that is pinned after that.
+func (p *certificatePin) pin(fingerprint []byte) []byte {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.fingerprint == nil {
+		p.fingerprint = fingerprint
+	}
+
+	return p.fingerprint
+}
@@ -0,0 +1,43 @@
+package chat
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLoadCertificate(t *testing.T) {
+	dir := t.TempDir()
+	cert, err := loadCertificate(dir)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	loaded, err := loadCertificate(dir)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if !bytes.Equal(loaded.Certificate[0], cert.Certificate[0]) {
+		t.Errorf("loaded certificate is different from saved certificate")
+	}
+}
+
+func TestCertificatePin(t *testing.T) {
+	p := &certificatePin{}
+
+	if fp := p.pin([]byte("first")); string(fp) != "first" {
+		t.Errorf("pinned = %s, want = first", fp)
+	}
+
+	if fp := p.pin([]byte("second")); string(fp) != "first" {
+		t.Errorf("pinned = %s, want = first", fp)
+	}
+
+	var empty *certificatePin
+
+	if fp := empty.get(); fp != nil {
+		t.Errorf("nil pin = %s, want = nil", fp)
+	}
+}
@@ -1,12 +1,21 @@
 package chat
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"errors"
 	"io"
 	"math"
+	"net"
+	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/Amaimersion/terminal-chat/network"
+	"github.com/Amaimersion/terminal-chat/protocol"
 )
 
 type Flags struct {
@@ -21,22 +30,74 @@ type Flags struct {
 
 	// TCP port to for server.
 	Port string
+
+	// Directory where keys are kept.
+	// Empty means default directory, see configDir.
+	ConfigDir string
 }
 
 type chatState struct {
-	rooms roomsState
-	users usersState
-	port  uint16
+	rooms  roomsState
+	users  usersState
+	port   uint16
+	client *network.Client
+
+	// tracks sendings that are not done yet
+	sending *sync.WaitGroup
+
+	// tracks acknowledgements of sent messages
+	deliveries *deliveryTracker
+
+	// rejects replayed requests
+	replays *replayGuard
+
+	// used for encryption of messages
+	keys keyPair
 }
 
+const (
+	// How long to wait for pending requests at exit.
+	shutdownTimeout = time.Second * 5
+
+	// Should be greater than idle timeout of client,
+	// so remote peers will close idle connections first.
+	serverIdleTimeout = time.Minute * 10
+	serverReadTimeout = time.Second * 30
+	serverMaxConns    = 256
+
+	// Long messages are sent at once, so all
+	// fragments should arrive almost together.
+	serverFragmentTimeout = time.Minute
+
+	// Should be enough for rooms with many users,
+	// but low enough to stop floods.
+	limiterRate         = 20
+	limiterBurst        = 50
+	limiterBanThreshold = 100
+	limiterBanDuration  = time.Minute * 5
+
+	// How long to wait for acknowledgement of sent
+	// message before reporting it as not delivered.
+	ackTimeout = time.Second * 10
+)
+
 // Run starts an interactive chat in terminal.
 //
+// It is equivalent to RunContext() with background context.
+func Run(flags Flags) error {
+	return RunContext(context.Background(), flags)
+}
+
+// RunContext starts an interactive chat in terminal.
+//
 // It is blocking function. nil will be returned
 // in case of normal exit, error will be returned
 // in case of unexpected critical error.
-func Run(flags Flags) error {
-	var err error
-
+//
+// Chat exits either when user asks for that or when ctx
+// is done. In both cases chat stops accepting of incoming
+// requests and waits until pending requests are done.
+func RunContext(ctx context.Context, flags Flags) (err error) {
 	state := chatState{
 		rooms: roomsState{
 			active:  0,
@@ -47,21 +108,93 @@ func Run(flags Flags) error {
 			added: make(map[roomID][]userInfo),
 		},
 		port: 0,
+		client: &network.Client{
+			IdleTimeout: network.DefaultClient.IdleTimeout,
+			KeepAlive:   network.DefaultClient.KeepAlive,
+			DialTimeout: network.DefaultClient.DialTimeout,
+
+			// Needed to know whether long messages can be sent
+			// and whether acknowledgements can be expected.
+			Handshake:    true,
+			Capabilities: protocol.CapAcks | protocol.CapEncryption,
+
+			// Certificates of users are self-signed,
+			// they are checked using pinning instead.
+			TLSConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+		sending:    &sync.WaitGroup{},
+		deliveries: newDeliveryTracker(ackTimeout),
+		replays:    newReplayGuard(replayWindow),
 	}
 
 	if state.port, err = parsePort(flags.Port); err != nil {
 		return err
 	}
 
+	state.client.ListenPort = state.port
+
+	dir, err := configDir(flags.ConfigDir)
+
+	if err != nil {
+		return err
+	}
+
+	if state.keys, err = loadKeyPair(dir); err != nil {
+		return errors.New("unable to load keys: " + err.Error())
+	}
+
+	if state.client.Identity, err = loadIdentity(dir); err != nil {
+		return errors.New("unable to load identity: " + err.Error())
+	}
+
+	cert, err := loadCertificate(dir)
+
+	if err != nil {
+		return errors.New("unable to load certificate: " + err.Error())
+	}
+
 	if state, err = initChat(flags.Out, state); err != nil {
 		return err
 	}
 
+	done := make(chan struct{})
+	server := &network.Server{
+		Address:         net.JoinHostPort(flags.Address, flags.Port),
+		IdleTimeout:     serverIdleTimeout,
+		ReadTimeout:     serverReadTimeout,
+		FragmentTimeout: serverFragmentTimeout,
+		MaxConns:        serverMaxConns,
+		Capabilities:    protocol.CapAcks | protocol.CapEncryption,
+		Limiter: &network.RateLimiter{
+			Rate:         limiterRate,
+			Burst:        limiterBurst,
+			BanThreshold: limiterBanThreshold,
+			BanDuration:  limiterBanDuration,
+		},
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
 	inputs, inErrs := listenInputs(flags.In)
-	requests, reqErrs := listenRequests(flags.Address, flags.Port)
+	requests, reqErrs := listenRequests(server, done)
+
+	defer func() {
+		close(done)
+
+		shutdownErr := shutdownChat(server, state)
+
+		if err == nil {
+			err = shutdownErr
+		}
+	}()
 
 	for {
 		select {
+		case <-ctx.Done():
+			return nil
 		case err = <-inErrs:
 			return err
 		case err = <-reqErrs:
@@ -78,10 +211,41 @@ func Run(flags Flags) error {
 			if state, err = handleRequest(flags.Out, state, req); err != nil {
 				return err
 			}
+		case d := <-state.deliveries.expired:
+			handleDeliveryReport(flags.Out, state, d, false)
 		}
 	}
 }
 
+// shutdownChat stops accepting of incoming requests and
+// waits until all pending requests are done.
+func shutdownChat(server *network.Server, st chatState) error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	serverErr := server.Shutdown(ctx)
+	st.deliveries.stop()
+	sent := make(chan struct{})
+
+	go func() {
+		st.sending.Wait()
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+	case <-ctx.Done():
+	}
+
+	clientErr := st.client.Shutdown(ctx)
+
+	if serverErr != nil {
+		return serverErr
+	}
+
+	return clientErr
+}
+
 func parsePort(s string) (uint16, error) {
 	i, err := strconv.Atoi(s)
 
@@ -96,6 +260,22 @@ func parsePort(s string) (uint16, error) {
 	return uint16(i), nil
 }
 
+// configDir returns dir if it is not empty,
+// otherwise returns default config directory.
+func configDir(dir string) (string, error) {
+	if len(dir) != 0 {
+		return dir, nil
+	}
+
+	base, err := os.UserConfigDir()
+
+	if err != nil {
+		return "", errors.New("unable to find config directory: " + err.Error())
+	}
+
+	return filepath.Join(base, "terminal-chat"), nil
+}
+
 func initChat(w io.Writer, state chatState) (chatState, error) {
 	var err error
 
@@ -138,22 +318,25 @@ func listenInputs(r io.Reader) (<-chan input, <-chan error) {
 	return inputs, errs
 }
 
-func listenRequests(ip, port string) (<-chan network.Request, <-chan error) {
+// listenRequests starts serving of incoming requests using server.
+//
+// Arrived requests will be sent to returned channel until
+// done is closed.
+func listenRequests(server *network.Server, done <-chan struct{}) (<-chan network.Request, <-chan error) {
 	requests := make(chan network.Request)
 	errs := make(chan error, 1)
 
-	network.HandleAll(func(req network.Request) {
-		requests <- req
+	server.HandleAll(func(req network.Request) {
+		select {
+		case requests <- req:
+		case <-done:
+		}
 	})
 
 	go func() {
-		defer close(requests)
-		defer close(errs)
+		err := server.ListenAndServe()
 
-		addr := ip + ":" + port
-		err := network.ListenAndServe(addr)
-
-		if err != nil {
+		if err != nil && err != network.ErrServerClosed {
 			errs <- err
 		}
 	}()
@@ -178,6 +361,10 @@ func handleInput(w io.Writer, st chatState, in input) (chatState, error) {
 	case commandStartRoom:
 		st.rooms, err = handleStartRoom(st.rooms, in.args[0])
 
+		if err == nil && len(in.args) > 1 {
+			st.rooms, err = handleProtectRoom(st.rooms, in.args[1])
+		}
+
 		if err == nil {
 			str, err = handleGetRoomURL(st.rooms, st.port)
 		}
@@ -193,13 +380,39 @@ func handleInput(w io.Writer, st chatState, in input) (chatState, error) {
 			url:   in.args[1],
 		}
 		st.users, err = handleAddUser(i)
+
+		if err == nil {
+			added := st.users.added[st.rooms.active]
+			user := added[len(added)-1]
+			room := st.rooms.started[st.rooms.active]
+
+			// user will send his key back if he already
+			// added us, otherwise he will send it when
+			// he adds us, so failures are not interesting
+			st.sending.Add(1)
+
+			go func() {
+				defer st.sending.Done()
+				user.addresses.refresh(user.url, st.client.Resolver)
+				handleSendKey(st.client, st.keys, user, room, false)
+			}()
+		}
 	case commandListUsers:
 		str = handleListUsers(st.rooms, st.users)
 	case commandDeleteUser:
 		st.users, err = handleDeleteUser(st.rooms, st.users, in.args[0])
+	case commandVerifyUser:
+		identity := st.client.Identity.Public().(ed25519.PublicKey)
+		str, err = handleVerifyUser(st.rooms, st.users, in.args[0], identity)
+	case commandTrustUser:
+		st.users, err = handleTrustUser(st.rooms, st.users, in.args[0])
+
+		if err == nil {
+			str = in.args[0] + " is verified"
+		}
 	case commandSendText:
 		var m message
-		errs, m = handleSendText(st.rooms, st.users, in.args[0])
+		errs, m = handleSendText(st.client, st.deliveries, st.keys, st.rooms, st.users, in.args[0])
 		s := m.string()
 		err = writeWithFormat(
 			w,
@@ -247,10 +460,14 @@ func handleInput(w io.Writer, st chatState, in input) (chatState, error) {
 	// We will not wait for async errors in order to not block thread.
 	// They will be printed under prompt. When they are done,
 	// we will print prompt once again.
+	if errs == nil {
+		return st, nil
+	}
+
+	st.sending.Add(1)
+
 	go func() {
-		if errs == nil {
-			return
-		}
+		defer st.sending.Done()
 
 		oneWritten := false
 
@@ -286,12 +503,51 @@ func handleInput(w io.Writer, st chatState, in input) (chatState, error) {
 }
 
 func handleRequest(w io.Writer, st chatState, req network.Request) (chatState, error) {
+	if req.Ack {
+		if !isAckAuthentic(st.rooms, req) {
+			return st, nil
+		}
+
+		d, ok := st.deliveries.confirm(req.MessageID, req.Remote, req.Identity, st.client.Resolver)
+
+		if ok {
+			handleDeliveryReport(w, st, d, true)
+		}
+
+		return st, nil
+	}
+
+	fresh := false
+
+	// requests of older versions don't have ID or timestamp,
+	// they are handled, but can't be trusted that much
+	if req.Identity != nil && req.MessageID != 0 && !req.Timestamp.IsZero() {
+		if !st.replays.check(req.Identity, req.MessageID, req.HandlerLocation, req.Timestamp, time.Now()) {
+			// It can occur because of spam.
+			// We will ignore it due to security reasons.
+			return st, nil
+		}
+
+		fresh = true
+	}
+
+	if req.ContentType == contentTypePublicKey || req.ContentType == contentTypePublicKeyReply {
+		return handleRequestKey(w, st, req, fresh), nil
+	}
+
 	inpt := handleReceiveTextInput{
-		rooms:    st.rooms,
-		users:    st.users,
-		from:     req.Remote,
-		location: req.HandlerLocation,
-		text:     req.Text,
+		rooms:       st.rooms,
+		users:       st.users,
+		from:        req.Remote,
+		location:    req.HandlerLocation,
+		text:        string(req.Payload),
+		contentType: req.ContentType,
+		sentAt:      req.Timestamp,
+		encrypted:   req.Encrypted,
+		keys:        st.keys,
+		identity:    req.Identity,
+		fresh:       fresh,
+		resolver:    st.client.Resolver,
 	}
 	users, message, err := handleReceiveText(inpt)
 	st.users = users
@@ -310,13 +566,33 @@ func handleRequest(w io.Writer, st chatState, req network.Request) (chatState, e
 			s,
 			wEndSpace,
 		)
+
+		st.sending.Add(1)
+
+		// acknowledgement failures are not interesting to user
+		// text was accepted, so room exists
+		id, _ := findRoom(st.rooms, req.HandlerLocation)
+		room := st.rooms.started[id]
+
+		go func() {
+			defer st.sending.Done()
+			handleSendAck(st.client, room, req)
+		}()
 	} else {
+		if err == errNoUserInDestinationRoom {
+			handleIdentityChange(w, st, req)
+		}
+
 		// These errors can occur because of spam.
 		// We will ignore them due to security reasons.
 		errShouldBeIgnored :=
 			err == errNoDestinationRoom ||
 				err == errNoUserInDestinationRoom ||
-				err == errReceivedTextIsInternal
+				err == errReceivedTextIsInternal ||
+				err == errReceivedDataIsNotText ||
+				err == errReceivedTextIsPlain ||
+				err == errUnableToDecrypt ||
+				err == errNotAuthenticated
 
 		if errShouldBeIgnored {
 			err = nil
@@ -325,3 +601,126 @@ func handleRequest(w io.Writer, st chatState, req network.Request) (chatState, e
 
 	return st, err
 }
+
+// handleRequestKey accepts public key that was received by req
+// and sends our key back unless req is reply to our key.
+// fresh is true if req passed check for replay.
+//
+// All errors are ignored, because they can occur because of spam.
+// Only changes of keys are reported.
+func handleRequestKey(w io.Writer, st chatState, req network.Request, fresh bool) chatState {
+	inpt := handleReceiveKeyInput{
+		rooms:     st.rooms,
+		users:     st.users,
+		from:      req.Remote,
+		identity:  req.Identity,
+		location:  req.HandlerLocation,
+		key:       req.Payload,
+		encrypted: req.Encrypted,
+		fresh:     fresh,
+		resolver:  st.client.Resolver,
+	}
+
+	users, sender, changed, replaced, err := handleReceiveKey(inpt)
+	st.users = users
+
+	if err == errNoUserInDestinationRoom {
+		handleIdentityChange(w, st, req)
+	}
+
+	if err == errKeyChanged {
+		s := "WARNING: " + sender.name + " (" + sender.url.String() + ") sent another encryption key!"
+		s += " It was rejected, because his identity is not known yet and somebody else may pretend to be him."
+		s += " If he really changed his key, then delete him and add him again."
+		handleWarning(w, st, s)
+	}
+
+	if replaced {
+		s := "WARNING: encryption key of " + sender.name + " (" + sender.url.String() + ") has changed."
+		s += " New key is signed by his identity, so it was accepted."
+		handleWarning(w, st, s)
+	}
+
+	// User could lose our key, for example, after restart, and
+	// he can't tell that, so every fresh request is answered.
+	// Replayed requests are answered only if key has changed.
+	answer := req.ContentType == contentTypePublicKey && (changed || fresh)
+
+	if err != nil || !answer {
+		return st
+	}
+
+	st.sending.Add(1)
+
+	// key was accepted, so room exists
+	id, _ := findRoom(st.rooms, req.HandlerLocation)
+	room := st.rooms.started[id]
+
+	go func() {
+		defer st.sending.Done()
+		handleSendKey(st.client, st.keys, sender, room, true)
+	}()
+
+	return st
+}
+
+// handleIdentityChange warns if request that was rejected by
+// handleReceiveText came from verified user, but was signed with
+// another identity. See findChangedIdentity.
+func handleIdentityChange(w io.Writer, st chatState, req network.Request) {
+	id, ok := findRoom(st.rooms, req.HandlerLocation)
+
+	if !ok {
+		return
+	}
+
+	u, ok := findChangedIdentity(st.users.added[id], req.Remote, req.Identity, st.client.Resolver)
+
+	if !ok {
+		return
+	}
+
+	s := "WARNING: key of verified user " + u.name + " (" + u.url.String() + ") has changed!"
+	s += " Somebody may pretend to be him, so his message was rejected."
+	s += " If he really changed his key, then delete him, add him again and verify him once again."
+	handleWarning(w, st, s)
+}
+
+// handleWarning shows warning about security of chat.
+func handleWarning(w io.Writer, st chatState, s string) {
+	writeWithFormat(
+		w,
+		s,
+		wEndNewline|wDeleteCurrentLine|wRedColor,
+	)
+
+	s = handlePrompt(st.rooms)
+	writeWithFormat(
+		w,
+		s,
+		wEndSpace,
+	)
+}
+
+// handleDeliveryReport shows whether message was delivered to user.
+func handleDeliveryReport(w io.Writer, st chatState, d delivery, delivered bool) {
+	flag := wEndNewline | wDeleteCurrentLine
+
+	if !delivered {
+		flag |= wRedColor
+	}
+
+	s := deliveryString(d, delivered)
+	writeWithFormat(
+		w,
+		s,
+		flag,
+	)
+
+	s = handlePrompt(st.rooms)
+	writeWithFormat(
+		w,
+		s,
+		wEndSpace,
+	)
+}
@@ -1,29 +1,42 @@
 package chat
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
 	"errors"
 	"io"
 	"math"
+	"net"
 	"strconv"
-	"strings"
+	"sync"
 	"testing"
 	"testing/iotest"
 	"time"
+
+	"github.com/Amaimersion/terminal-chat/network"
+	"github.com/Amaimersion/terminal-chat/protocol"
 )
 
 func TestRunBadAddress(t *testing.T) {
 	done := make(chan bool)
 	timer := time.After(time.Second * 3)
 
+	// input is never closed, otherwise chat
+	// may exit normally before server fails
+	r, w := io.Pipe()
+	defer w.Close()
+
 	go func() {
 		defer func() {
 			done <- true
 		}()
 
 		f := Flags{
-			In:   strings.NewReader(""),
-			Out:  io.Discard,
-			Port: "1234",
+			In:        r,
+			Out:       io.Discard,
+			Port:      "1234",
+			ConfigDir: t.TempDir(),
 
 			// For bad address we can use either non-resolvable hostname or
 			// IP address with TCP port. IP along with TCP port is not allowed
@@ -57,10 +70,11 @@ func TestRunBadIn(t *testing.T) {
 		e := errors.New("simulated error")
 		r := iotest.ErrReader(e)
 		f := Flags{
-			In:      r,
-			Out:     io.Discard,
-			Address: "127.0.0.1",
-			Port:    "1234",
+			In:        r,
+			Out:       io.Discard,
+			Address:   "127.0.0.1",
+			Port:      "1234",
+			ConfigDir: t.TempDir(),
 		}
 		err := Run(f)
 
@@ -77,6 +91,72 @@ func TestRunBadIn(t *testing.T) {
 	}
 }
 
+func TestRunContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	r, w := io.Pipe()
+	defer w.Close()
+
+	go func() {
+		f := Flags{
+			In:        r,
+			Out:       io.Discard,
+			Address:   "127.0.0.1",
+			Port:      "0",
+			ConfigDir: t.TempDir(),
+		}
+		done <- RunContext(ctx, f)
+	}()
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("err = %v, want = nil", err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Errorf("timeout")
+	}
+}
+
+func TestRunIPv6Address(t *testing.T) {
+	if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("IPv6 is not available")
+	} else {
+		l.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	r, w := io.Pipe()
+	defer w.Close()
+
+	go func() {
+		f := Flags{
+			In:        r,
+			Out:       io.Discard,
+			Address:   "::1",
+			Port:      "0",
+			ConfigDir: t.TempDir(),
+		}
+		done <- RunContext(ctx, f)
+	}()
+
+	// give server a time to fail
+	time.Sleep(time.Millisecond * 300)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("err = %v, want = nil", err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Errorf("timeout")
+	}
+}
+
 func TestParsePort(t *testing.T) {
 	p, err := parsePort("1234")
 
@@ -117,3 +197,88 @@ func TestInitChat(t *testing.T) {
 		t.Errorf("err = %v, want nil", err)
 	}
 }
+
+func TestHandleRequestKeyAnswer(t *testing.T) {
+	server := network.Server{
+		Capabilities: protocol.CapEncryption,
+	}
+	url, requests := startUserServer(t, &server)
+	defer server.Shutdown(context.Background())
+
+	client := &network.Client{
+		Handshake: true,
+	}
+	defer client.Close()
+
+	keys, _ := generateKeyPair()
+	userKeys, _ := generateKeyPair()
+	identity, _, _ := ed25519.GenerateKey(nil)
+	url.Location = 5
+	user := userInfo{
+		name:     "user1",
+		url:      url,
+		key:      &userKeys.public,
+		identity: identity,
+	}
+	st := chatState{
+		rooms: handleReceiveTextInpt.rooms,
+		users: usersState{
+			added: map[roomID][]userInfo{
+				1: {user},
+			},
+		},
+		client:  client,
+		sending: &sync.WaitGroup{},
+		replays: newReplayGuard(replayWindow),
+		keys:    keys,
+	}
+
+	// user already has been added, but he was restarted
+	// and lost our key, so he sends the same key again
+	req := network.Request{
+		Payload:         userKeys.public[:],
+		ContentType:     contentTypePublicKey,
+		Remote:          url,
+		HandlerLocation: 1,
+		Identity:        identity,
+		MessageID:       1,
+		Timestamp:       time.Now(),
+	}
+	st, err := handleRequest(io.Discard, st, req)
+	st.sending.Wait()
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	select {
+	case r := <-requests:
+		if r.ContentType != contentTypePublicKeyReply {
+			t.Errorf("content type = %v, want = %v", r.ContentType, contentTypePublicKeyReply)
+		}
+
+		if !bytes.Equal(r.Payload, keys.public[:]) {
+			t.Errorf("key = %v, want = %v", r.Payload, keys.public)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout, want key")
+	}
+
+	replayed := req
+	reply := req
+	reply.ContentType = contentTypePublicKeyReply
+	reply.MessageID = 2
+	unknownFreshness := req
+	unknownFreshness.MessageID = 0
+
+	for _, r := range []network.Request{replayed, reply, unknownFreshness} {
+		st, _ = handleRequest(io.Discard, st, r)
+		st.sending.Wait()
+	}
+
+	select {
+	case r := <-requests:
+		t.Errorf("request = %v, want nothing", r)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
@@ -0,0 +1,162 @@
+package chat
+
+import (
+	"crypto/ed25519"
+	"sync"
+	"time"
+
+	"github.com/Amaimersion/terminal-chat/network"
+	"github.com/Amaimersion/terminal-chat/protocol"
+)
+
+// delivery is a message that was sent to single user
+// and waits for acknowledgement from that user.
+type delivery struct {
+	id    uint64
+	user  userInfo
+	room  string
+	text  string
+	timer *time.Timer
+}
+
+// deliveryTracker tracks acknowledgements of sent messages.
+//
+// Messages that are not acknowledged in time are sent
+// to expired channel. deliveryTracker is safe for
+// concurrent use.
+type deliveryTracker struct {
+	// How long to wait for acknowledgement.
+	timeout time.Duration
+
+	// Receives messages that were not acknowledged in time.
+	expired chan delivery
+
+	mu      sync.Mutex
+	pending map[uint64][]*delivery
+	done    chan struct{}
+	stopped bool
+}
+
+func newDeliveryTracker(timeout time.Duration) *deliveryTracker {
+	t := &deliveryTracker{
+		timeout: timeout,
+		expired: make(chan delivery),
+		pending: make(map[uint64][]*delivery),
+		done:    make(chan struct{}),
+	}
+
+	return t
+}
+
+// expect starts waiting for acknowledgement of message
+// with id from user. It should be called before sending,
+// because acknowledgement may arrive very fast.
+func (t *deliveryTracker) expect(id uint64, user userInfo, room, text string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return
+	}
+
+	d := &delivery{
+		id:   id,
+		user: user,
+		room: room,
+		text: text,
+	}
+	d.timer = time.AfterFunc(t.timeout, func() {
+		if t.remove(d) {
+			select {
+			case t.expired <- *d:
+			case <-t.done:
+			}
+		}
+	})
+	t.pending[id] = append(t.pending[id], d)
+}
+
+// forget stops waiting for acknowledgement of message
+// with id from user, for example, if sending has failed.
+func (t *deliveryTracker) forget(id uint64, user userInfo) {
+	t.mu.Lock()
+	list := t.pending[id]
+	t.mu.Unlock()
+
+	for _, d := range list {
+		if d.user.name == user.name && d.user.url.IsEqual(user.url) {
+			t.remove(d)
+		}
+	}
+}
+
+// confirm handles acknowledgement of message with id
+// that was sent by from and signed with identity.
+//
+// Acknowledged delivery will be returned. false will be
+// returned if nobody waits for such acknowledgement.
+func (t *deliveryTracker) confirm(id uint64, from protocol.URL, identity ed25519.PublicKey, r network.Resolver) (delivery, bool) {
+	t.mu.Lock()
+	list := t.pending[id]
+	t.mu.Unlock()
+
+	// user may be added by host name that should be
+	// resolved, so lock is not held during matching
+	for _, d := range list {
+		if isSender(d.user, from, identity, r) && t.remove(d) {
+			return *d, true
+		}
+	}
+
+	return delivery{}, false
+}
+
+// remove stops waiting for d. false will be
+// returned if nobody waits for d already.
+func (t *deliveryTracker) remove(d *delivery) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := t.pending[d.id]
+
+	for i, x := range list {
+		if x != d {
+			continue
+		}
+
+		d.timer.Stop()
+		list = append(list[:i], list[i+1:]...)
+
+		if len(list) == 0 {
+			delete(t.pending, d.id)
+		} else {
+			t.pending[d.id] = list
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// stop stops waiting for all acknowledgements.
+// Tracker can't be used after that.
+func (t *deliveryTracker) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return
+	}
+
+	t.stopped = true
+	close(t.done)
+
+	for id, list := range t.pending {
+		for _, d := range list {
+			d.timer.Stop()
+		}
+
+		delete(t.pending, id)
+	}
+}
@@ -0,0 +1,157 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Amaimersion/terminal-chat/network"
+	"github.com/Amaimersion/terminal-chat/protocol"
+)
+
+var deliveryUser = userInfo{
+	name: "user1",
+	url: protocol.URL{
+		Address:  []byte{127, 0, 0, 1},
+		Port:     3333,
+		Location: 5,
+	},
+}
+
+func TestDeliveryConfirm(t *testing.T) {
+	tracker := newDeliveryTracker(time.Second)
+	defer tracker.stop()
+
+	tracker.expect(1, deliveryUser, "room", "text")
+	d, ok := tracker.confirm(1, deliveryUser.url, nil, nil)
+
+	if !ok {
+		t.Fatalf("ok = %v, want = %v", ok, true)
+	}
+
+	if d.user.name != deliveryUser.name || d.room != "room" || d.text != "text" {
+		t.Errorf("delivery = %v, want delivery of expected message", d)
+	}
+
+	// second acknowledgement should be ignored
+	if _, ok := tracker.confirm(1, deliveryUser.url, nil, nil); ok {
+		t.Errorf("ok = %v, want = %v", ok, false)
+	}
+}
+
+func TestDeliveryConfirmFromAnotherUser(t *testing.T) {
+	tracker := newDeliveryTracker(time.Second)
+	defer tracker.stop()
+
+	tracker.expect(1, deliveryUser, "room", "text")
+	from := deliveryUser.url
+	from.Location = 6
+
+	if _, ok := tracker.confirm(1, from, nil, nil); ok {
+		t.Errorf("ok = %v, want = %v", ok, false)
+	}
+}
+
+func TestDeliveryTimeout(t *testing.T) {
+	tracker := newDeliveryTracker(time.Millisecond * 10)
+	defer tracker.stop()
+
+	tracker.expect(1, deliveryUser, "room", "text")
+
+	select {
+	case d := <-tracker.expired:
+		if d.id != 1 || d.user.name != deliveryUser.name {
+			t.Errorf("delivery = %v, want delivery of expected message", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout, want expired delivery")
+	}
+
+	if _, ok := tracker.confirm(1, deliveryUser.url, nil, nil); ok {
+		t.Errorf("ok = %v, want = %v", ok, false)
+	}
+}
+
+func TestDeliveryForget(t *testing.T) {
+	tracker := newDeliveryTracker(time.Millisecond * 10)
+	defer tracker.stop()
+
+	tracker.expect(1, deliveryUser, "room", "text")
+	tracker.forget(1, deliveryUser)
+
+	select {
+	case d := <-tracker.expired:
+		t.Errorf("delivery = %v, want nothing", d)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestDeliveryString(t *testing.T) {
+	d := delivery{
+		user: deliveryUser,
+		room: "room",
+		text: "text",
+	}
+
+	if s, want := deliveryString(d, true), "room delivered to user1: text"; s != want {
+		t.Errorf("result = %v, want = %v", s, want)
+	}
+
+	if s, want := deliveryString(d, false), "room not delivered to user1: text"; s != want {
+		t.Errorf("result = %v, want = %v", s, want)
+	}
+}
+
+func TestHandleSendAckWithoutCapability(t *testing.T) {
+	req := network.Request{
+		MessageID: 1,
+	}
+
+	// request has empty remote, so sending would fail
+	if err := handleSendAck(&network.Client{}, roomInfo{}, req); err != nil {
+		t.Errorf("err = %v, want = nil", err)
+	}
+}
+
+func TestHandleSendTextExpectsAck(t *testing.T) {
+	server := network.Server{
+		Capabilities: protocol.CapAcks,
+	}
+	url, requests := startUserServer(t, &server)
+	defer server.Shutdown(context.Background())
+
+	client := &network.Client{
+		Handshake: true,
+	}
+	defer client.Close()
+
+	tracker := newDeliveryTracker(time.Second)
+	defer tracker.stop()
+
+	url.Location = 5
+	user := userInfo{
+		name: "user1",
+		url:  url,
+	}
+	rooms := handleSendTextInputRooms
+	users := usersState{
+		added: map[roomID][]userInfo{
+			rooms.active: {user},
+		},
+	}
+	errs, _ := handleSendText(client, tracker, keyPair{}, rooms, users, "text")
+
+	for err := range errs {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	req := <-requests
+
+	if req.MessageID == 0 {
+		t.Fatalf("message ID = 0, want some ID")
+	}
+
+	if _, ok := tracker.confirm(req.MessageID, user.url, nil, nil); !ok {
+		t.Errorf("ok = %v, want = %v", ok, true)
+	}
+}
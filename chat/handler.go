@@ -1,6 +1,9 @@
 package chat
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"sync"
@@ -65,15 +68,21 @@ func handleHelp() string {
 	m += "\n"
 	m += commandStartRoom.text + " <name> - start a new room with specific name or switch to existing one. Maximum number of started rooms is " + fmt.Sprint(maxRooms) + "."
 	m += "\n"
+	m += commandStartRoom.text + " <name> " + optionSecret + " <passphrase> - same as above, but protect room with passphrase. Users should protect their rooms with the same passphrase, messages without it will be rejected."
+	m += "\n"
 	m += commandListRooms.text + " - print information about all started rooms"
 	m += "\n"
 	m += commandDeleteRoom.text + " <name> - delete room with specific name"
 	m += "\n"
-	m += commandAddUser.text + " <name> <URL> - add a user with specific name in current room. This user will be allowed to send messages to you. URL is a this user response room URL, ask for it from him."
+	m += commandAddUser.text + " <name> <URL> - add a user with specific name in current room. This user will be allowed to send messages to you. URL is a this user response room URL, ask for it from him. Use sttps:// scheme in order to protect connection with TLS."
 	m += "\n"
 	m += commandListUsers.text + " - print information about all users in current room"
 	m += "\n"
 	m += commandDeleteUser.text + " <name> - delete user with specific name"
+	m += "\n"
+	m += commandVerifyUser.text + " <name> - print safety number of user with specific name. Compare it with number that this user sees, for example, in person or by phone."
+	m += "\n"
+	m += commandTrustUser.text + " <name> - mark user with specific name as verified after comparing of safety numbers. You will be warned if key of verified user changes."
 
 	return m
 }
@@ -97,9 +106,16 @@ type roomID uint
 type roomInfo struct {
 	name string
 
-	// Allowed values are from 0 to 15 due to protocol limitations.
-	// Should be unique at runtime.
-	location uint8
+	// Should be unique at runtime. Values above 15 require
+	// support of wide locations by remote peers, so lowest
+	// free values are used first to stay compatible with
+	// peers that use 4-bit locations.
+	location uint16
+
+	// Key that is derived from passphrase of room. Every
+	// payload to and from room is encrypted with it, see
+	// sealRoomPayload. nil means room is not protected.
+	secret *[keyLength]byte
 }
 
 type roomsState struct {
@@ -109,7 +125,7 @@ type roomsState struct {
 }
 
 const (
-	maxRooms = 16
+	maxRooms = 256
 )
 
 var (
@@ -153,7 +169,7 @@ func handleStartRoom(rooms roomsState, name string) (roomsState, error) {
 
 	info := roomInfo{
 		name:     name,
-		location: uint8(location),
+		location: uint16(location),
 	}
 	rooms.started[rooms.nextNew] = info
 	rooms.active = rooms.nextNew
@@ -172,7 +188,13 @@ func handleListRooms(rooms roomsState, users usersState) string {
 		}
 
 		m += r.name
-		m += " (users - " + fmt.Sprint(len(users.added[id])) + ")"
+		m += " (users - " + fmt.Sprint(len(users.added[id]))
+
+		if r.secret != nil {
+			m += ", protected with secret"
+		}
+
+		m += ")"
 		m += "\n"
 	}
 
@@ -185,6 +207,90 @@ func handleListRooms(rooms roomsState, users usersState) string {
 	return m
 }
 
+// handleProtectRoom protects active room with key that is
+// derived from passphrase. Only users who know the same
+// passphrase will be able to communicate in that room.
+// Previous passphrase is replaced.
+func handleProtectRoom(rooms roomsState, passphrase string) (roomsState, error) {
+	info, ok := rooms.started[rooms.active]
+
+	if !ok {
+		return rooms, errRoomNotStarted
+	}
+
+	key, err := deriveRoomKey(passphrase)
+
+	if err != nil {
+		return rooms, err
+	}
+
+	info.secret = key
+	rooms.started[rooms.active] = info
+
+	return rooms, nil
+}
+
+// Marks that are put before payload that is protected with
+// secret of room. Encryption flag of request only tells that
+// whole payload is protected, so receiver uses them to know
+// whether payload itself is encrypted with his key.
+const (
+	roomPayloadPlain byte = iota
+	roomPayloadBoxed
+)
+
+// sealRoomPayload protects payload that is sent from room
+// using secret of room. boxed tells whether payload is
+// already encrypted with key of receiver. encrypted reports
+// whether result is encrypted in any way. Payload is returned
+// as is if room is not protected.
+func sealRoomPayload(room roomInfo, payload []byte, boxed bool) (result []byte, encrypted bool, err error) {
+	if room.secret == nil {
+		return payload, boxed, nil
+	}
+
+	mark := roomPayloadPlain
+
+	if boxed {
+		mark = roomPayloadBoxed
+	}
+
+	result, err = sealSecret(room.secret, append([]byte{mark}, payload...))
+
+	return result, err == nil, err
+}
+
+// openRoomPayload removes protection of payload that was
+// received by room, see sealRoomPayload. encrypted is a flag
+// of request. boxed reports whether returned payload is still
+// encrypted with key of sender. Payload is returned as is if
+// room is not protected. false will be returned if payload
+// can't be authenticated using secret of room.
+func openRoomPayload(room roomInfo, payload []byte, encrypted bool) (data []byte, boxed bool, ok bool) {
+	if room.secret == nil {
+		return payload, encrypted, true
+	}
+
+	if !encrypted {
+		return nil, false, false
+	}
+
+	data, ok = openSecret(room.secret, payload)
+
+	if !ok || len(data) == 0 {
+		return nil, false, false
+	}
+
+	switch data[0] {
+	case roomPayloadPlain:
+		return data[1:], false, true
+	case roomPayloadBoxed:
+		return data[1:], true, true
+	default:
+		return nil, false, false
+	}
+}
+
 var (
 	errNoSuchRoom = errors.New("no such room")
 )
@@ -231,6 +337,29 @@ func handleDeleteRoom(rooms roomsState, users usersState, name string) (roomsSta
 type userInfo struct {
 	name string
 	url  protocol.URL
+
+	// Public key that was received from user.
+	// nil means that user didn't send it yet, so
+	// messages are exchanged without encryption.
+	key *[keyLength]byte
+
+	// Identity key that signed first signed request from
+	// user. After that user is identified by this key
+	// instead of URL. nil means that user didn't sign
+	// anything yet, for example, he uses older version.
+	identity ed25519.PublicKey
+
+	// Fingerprint of TLS certificate of user with secure URL.
+	// It is pinned at first connection, after that nothing
+	// will be sent if user presents another certificate.
+	certificate *certificatePin
+
+	// Whether identity was verified by comparing of
+	// safety numbers, see handleVerifyUser.
+	verified bool
+
+	// Resolved addresses of user with host name.
+	addresses *resolvedURLs
 }
 
 type usersState struct {
@@ -275,8 +404,10 @@ func handleAddUser(in handleAddUserInput) (usersState, error) {
 	}
 
 	info := userInfo{
-		name: in.name,
-		url:  url,
+		name:        in.name,
+		url:         url,
+		certificate: &certificatePin{},
+		addresses:   &resolvedURLs{},
 	}
 	in.users.added[roomID] = append(in.users.added[roomID], info)
 
@@ -290,7 +421,21 @@ func handleListUsers(rooms roomsState, users usersState) string {
 	if usrs, ok := users.added[rooms.active]; ok {
 		for _, u := range usrs {
 			m += u.name
-			m += " (URL - " + u.url.String() + ")"
+			m += " (URL - " + u.url.String()
+
+			if u.identity != nil {
+				m += ", identity - " + fingerprint(u.identity)
+			}
+
+			if fp := u.certificate.get(); fp != nil {
+				m += ", certificate - " + formatFingerprint(fp)
+			}
+
+			if u.verified {
+				m += ", verified"
+			}
+
+			m += ")"
 			m += "\n"
 		}
 	}
@@ -334,16 +479,107 @@ func handleDeleteUser(rooms roomsState, users usersState, name string) (usersSta
 	return users, nil
 }
 
-// handleSendText handles sending of text to all users in active room.
+var (
+	errUnknownIdentity = errors.New("user didn't send his identity yet, wait for his message")
+)
+
+// handleVerifyUser returns safety numbers of all users with
+// specific name in active room. identity is our identity key.
+//
+// errNoSuchUser will be returned in case if such user doesn't
+// exists. errUnknownIdentity will be returned if identity
+// of user is not known yet.
+func handleVerifyUser(rooms roomsState, users usersState, name string, identity ed25519.PublicKey) (string, error) {
+	m := ""
+	found := false
+
+	for _, u := range users.added[rooms.active] {
+		if u.name != name {
+			continue
+		}
+
+		found = true
+
+		if u.identity == nil {
+			continue
+		}
+
+		m += "Safety number of " + u.name + " (" + u.url.String() + "):"
+		m += "\n"
+		m += safetyNumber(identity, u.identity)
+		m += "\n"
+	}
+
+	if !found {
+		return "", errNoSuchUser
+	}
+
+	if len(m) == 0 {
+		return "", errUnknownIdentity
+	}
+
+	m += "Ask " + name + " to compare it with his number for you."
+	m += " If numbers are the same, then type \"" + commandTrustUser.text + " " + name + "\"."
+
+	return m, nil
+}
+
+// handleTrustUser marks all users with specific name in active
+// room as verified. Users are modified in place.
+//
+// Same errors as for handleVerifyUser will be returned.
+func handleTrustUser(rooms roomsState, users usersState, name string) (usersState, error) {
+	added := users.added[rooms.active]
+	found := false
+	trusted := false
+
+	for i, u := range added {
+		if u.name != name {
+			continue
+		}
+
+		found = true
+
+		if u.identity != nil {
+			added[i].verified = true
+			trusted = true
+		}
+	}
+
+	if !found {
+		return users, errNoSuchUser
+	}
+
+	if !trusted {
+		return users, errUnknownIdentity
+	}
+
+	return users, nil
+}
+
+// handleSendText handles sending of text to all users in active room
+// using client.
 //
 // Channel which returns all errors that occurred during requests
 // will be returned. It will be closed when all requests will be done
 // (either with success or fail). Message composed on behalf of user
 // will be returned.
-func handleSendText(rooms roomsState, users usersState, text string) (<-chan error, message) {
+//
+// If deliveries is not nil, then acknowledgements will be expected
+// from users that support them. Text is encrypted using keys for
+// users whose public key is known. Text is not sent to users whose
+// TLS certificate doesn't match pinned one, see handlePinCertificate.
+// If active room is protected with secret, then text is encrypted
+// with room key as well.
+func handleSendText(client *network.Client, deliveries *deliveryTracker, keys keyPair, rooms roomsState, users usersState, text string) (<-chan error, message) {
 	var wg sync.WaitGroup
 	errs := make(chan error)
 	responseRoom := rooms.started[rooms.active]
+	now := time.Now()
+
+	// ID is needed only for acknowledgements, so message
+	// can be sent without it, zero ID is returned on error.
+	id, _ := network.NewMessageID()
 
 	// we will not allow zero-length text from user
 	// because it is reserved for internal purposes.
@@ -351,8 +587,14 @@ func handleSendText(rooms roomsState, users usersState, text string) (<-chan err
 		receivers := users.added[rooms.active]
 
 		for _, user := range receivers {
+			user := user
 			req := network.Request{
-				Text:            text,
+				Payload:         []byte(text),
+				ContentType:     protocol.ContentTypeText,
+				Checksum:        true,
+				Compress:        true,
+				Timestamp:       now,
+				MessageID:       id,
 				Remote:          user.url,
 				HandlerLocation: responseRoom.location,
 			}
@@ -361,7 +603,71 @@ func handleSendText(rooms roomsState, users usersState, text string) (<-chan err
 			go func() {
 				defer wg.Done()
 
-				if err := network.Send(req); err != nil {
+				// addresses are refreshed here, so responses
+				// will be matched without DNS queries
+				user.addresses.refresh(user.url, client.Resolver)
+
+				if user.key != nil {
+					payload, err := keys.seal(user.key, req.Payload)
+
+					if err != nil {
+						errs <- err
+						return
+					}
+
+					// encrypted data can't be compressed
+					req.Payload = payload
+					req.Encrypted = true
+					req.Compress = false
+				}
+
+				payload, encrypted, err := sealRoomPayload(responseRoom, req.Payload, req.Encrypted)
+
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if encrypted {
+					req.Payload = payload
+					req.Encrypted = true
+					req.Compress = false
+				}
+
+				fp, err := handlePinCertificate(client, user)
+
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				req.CertificateFingerprint = fp
+				track := deliveries != nil && id != 0
+
+				if track {
+					caps, err := client.PeerCapabilities(user.url)
+
+					if err != nil {
+						errs <- err
+						return
+					}
+
+					track = caps.Has(protocol.CapAcks)
+				}
+
+				if track {
+					deliveries.expect(id, user, responseRoom.name, text)
+				}
+
+				if err := client.Send(req); err != nil {
+					if track {
+						deliveries.forget(id, user)
+					}
+
+					if errors.Is(err, network.ErrCertificateMismatch) {
+						err = certificateWarning(user, err)
+					}
+
 					errs <- err
 				}
 			}()
@@ -377,92 +683,185 @@ func handleSendText(rooms roomsState, users usersState, text string) (<-chan err
 		outgoing: true,
 		text:     text,
 		room:     responseRoom.name,
-		at:       time.Now(),
+		at:       now,
 	}
 
 	return errs, m
 }
 
+// handleSendAck acknowledges message that was received by req
+// and accepted by handleReceiveText using client.
+//
+// Nothing will be sent if sender doesn't support acknowledgements
+// or it is impossible to respond to sender. If room that received
+// message is protected with secret, then acknowledgement carries
+// message ID that is encrypted with room key.
+func handleSendAck(client *network.Client, room roomInfo, req network.Request) error {
+	canAck :=
+		req.Capabilities.Has(protocol.CapAcks) &&
+			req.MessageID != 0 &&
+			req.Remote.Port != 0
+
+	if !canAck {
+		return nil
+	}
+
+	ack := network.Request{
+		Ack:       true,
+		MessageID: req.MessageID,
+		Remote:    req.Remote,
+
+		// sender expects that we respond from
+		// location of room that received message
+		HandlerLocation: req.HandlerLocation,
+	}
+
+	if room.secret != nil {
+		payload, _, err := sealRoomPayload(room, ackPayload(req.MessageID), false)
+
+		if err != nil {
+			return err
+		}
+
+		ack.Payload = payload
+		ack.Encrypted = true
+	}
+
+	return client.Send(ack)
+}
+
+// ackPayload returns payload of acknowledgement
+// of message with id in protected room.
+func ackPayload(id uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, id)
+
+	return data
+}
+
+// isAckAuthentic reports whether acknowledgement req can be
+// accepted. Acknowledgement that is received by protected room
+// should carry message ID that is encrypted with room key.
+func isAckAuthentic(rooms roomsState, req network.Request) bool {
+	id, ok := findRoom(rooms, req.HandlerLocation)
+
+	if !ok {
+		return false
+	}
+
+	data, _, ok := openRoomPayload(rooms.started[id], req.Payload, req.Encrypted)
+
+	if !ok {
+		return false
+	}
+
+	return rooms.started[id].secret == nil || bytes.Equal(data, ackPayload(req.MessageID))
+}
+
 type handleReceiveTextInput struct {
 	rooms    roomsState
 	users    usersState
 	from     protocol.URL
-	location uint8
+	location uint16
 	text     string
+
+	// MIME type of received payload, only text can be shown
+	contentType string
+
+	// Whether text is encrypted by sender, it is decrypted
+	// using secret of room, keys and key of sender
+	encrypted bool
+	keys      keyPair
+
+	// Verified identity of sender, nil if text is not signed
+	identity ed25519.PublicKey
+
+	// When text was written by sender, zero if unknown
+	sentAt time.Time
+
+	// Whether signed text is checked for replay,
+	// only such text can change URL of sender
+	fresh bool
+
+	// Used to resolve host names of users.
+	// nil means default resolver.
+	resolver network.Resolver
 }
 
 var (
 	errNoDestinationRoom       = errors.New("destination room doesn't exists")
 	errNoUserInDestinationRoom = errors.New("no such user in destination room")
 	errReceivedTextIsInternal  = errors.New("received text is for internal purposes only")
+	errReceivedDataIsNotText   = errors.New("received data is not a text")
+	errReceivedTextIsPlain     = errors.New("received text is not encrypted")
+	errUnableToDecrypt         = errors.New("unable to decrypt received text")
+	errNotAuthenticated        = errors.New("received data is not authenticated with room secret")
 )
 
 // handleReceiveText handles receiving of text from remote user.
 //
 // If destination room doesn't exists, then errNoDestinationRoom
-// will be returned. If sender doesn't exists in destination room,
+// will be returned. If destination room is protected with secret,
+// then errNotAuthenticated will be returned for text that is not
+// encrypted with room key. If sender doesn't exists in destination room,
 // then messages from him are not allowed due to security reasons
-// and errNoUserInDestinationRoom will be returned. If received text
-// is reserved to be used only for internal purposes, then
-// errReceivedTextIsInternal will be returned, but all internal actions
-// will be maded.
+// and errNoUserInDestinationRoom will be returned. If sender have
+// sent public key, then only encrypted text is accepted from him,
+// errReceivedTextIsPlain will be returned for plain text and
+// errUnableToDecrypt will be returned if text can't be decrypted.
+// If received text is reserved to be used only for internal purposes,
+// then errReceivedTextIsInternal will be returned, but all internal
+// actions will be maded. If received data is not a text, then
+// errReceivedDataIsNotText will be returned.
 //
-// If actual sender information doesn't match to local information
-// about sender, then local info will be updated with actual data,
-// that's why usersState will be returned.
+// Sender is identified by his identity key if it is known,
+// see findSender. Updated usersState is returned.
 //
 // Composed message from sender will be returned.
 func handleReceiveText(in handleReceiveTextInput) (usersState, message, error) {
-	var destRoom roomInfo
-	var destRoomID roomID
-	ok := false
+	destRoomID, ok := findRoom(in.rooms, in.location)
 
-	for id, r := range in.rooms.started {
-		if r.location == in.location {
-			destRoom = r
-			destRoomID = id
-			ok = true
-			break
-		}
+	if !ok {
+		return in.users, message{}, errNoDestinationRoom
 	}
 
+	destRoom := in.rooms.started[destRoomID]
+	data, boxed, ok := openRoomPayload(destRoom, []byte(in.text), in.encrypted)
+
 	if !ok {
-		return in.users, message{}, errNoDestinationRoom
+		return in.users, message{}, errNotAuthenticated
 	}
 
-	var sender userInfo
-	var senderIndx int
-	ok = false
+	in.text = string(data)
+	in.encrypted = boxed
+	i, ok := findSender(in.users.added[destRoomID], in.from, in.identity, in.resolver)
 
-	for i, u := range in.users.added[destRoomID] {
-		if u.url.IsEqualIP(in.from) {
-			// TODO:
-			// upcoming behavior (actualization of location),
-			// doesn't works correctly with multiple clients
-			// (different TCP ports, locations, etc.).
-			// So, at the moment we will not allow different location.
-			if in.from.Location != u.url.Location {
-				continue
-			}
+	if !ok {
+		return in.users, message{}, errNoUserInDestinationRoom
+	}
 
-			sender = u
-			senderIndx = i
-			ok = true
+	sender := in.users.added[destRoomID][i]
 
-			break
+	if sender.key != nil {
+		if !in.encrypted {
+			return in.users, message{}, errReceivedTextIsPlain
 		}
-	}
 
-	if !ok {
-		return in.users, message{}, errNoUserInDestinationRoom
+		text, ok := in.keys.open(sender.key, []byte(in.text))
+
+		if !ok {
+			return in.users, message{}, errUnableToDecrypt
+		}
+
+		in.text = string(text)
+	} else if in.encrypted {
+		return in.users, message{}, errUnableToDecrypt
 	}
 
-	// sender changed its location, old one not valid anymore.
-	// TODO:
-	// doesn't works correctly.
-	if sender.url.Location != in.from.Location {
-		sender.url.Location = in.from.Location
-		in.users.added[destRoomID][senderIndx] = sender
+	bindSender(in.users.added[destRoomID], i, in.from, in.identity, in.fresh)
+
+	if !protocol.IsTextContentType(in.contentType) {
+		return in.users, message{}, errReceivedDataIsNotText
 	}
 
 	if len(in.text) == 0 {
@@ -474,12 +873,334 @@ func handleReceiveText(in handleReceiveTextInput) (usersState, message, error) {
 		from:     sender.name,
 		room:     destRoom.name,
 		at:       time.Now(),
+		sentAt:   in.sentAt,
 		outgoing: false,
 	}
 
 	return in.users, m, nil
 }
 
+// findRoom returns ID of started room with location.
+// false will be returned if there is no such room.
+func findRoom(rooms roomsState, location uint16) (roomID, bool) {
+	for id, r := range rooms.started {
+		if r.location == location {
+			return id, true
+		}
+	}
+
+	return 0, false
+}
+
+// findSender returns index of user who sent request from URL
+// signed with identity. false will be returned if there is no
+// such user. See isSender for how users are matched.
+func findSender(users []userInfo, from protocol.URL, identity ed25519.PublicKey, r network.Resolver) (int, bool) {
+	for i, u := range users {
+		if isSender(u, from, identity, r) {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// bindSender updates user with index i after his request from
+// URL signed with identity was accepted. It should be called only
+// after request is authenticated as much as possible.
+//
+// First identity of user is remembered, so after that user stays
+// the same even if his IP address changes. In that case URL of
+// user is updated, so responses will be sent to new address.
+// URL is updated only by fresh request, otherwise anybody could
+// redirect responses by replaying old request of user.
+// Users are modified in place.
+func bindSender(users []userInfo, i int, from protocol.URL, identity ed25519.PublicKey, fresh bool) {
+	if users[i].identity == nil {
+		users[i].identity = identity
+	}
+
+	if users[i].identity != nil && fresh {
+		users[i].url = movedURL(users[i].url, from)
+	}
+}
+
+// findChangedIdentity returns verified user who would be a sender
+// of request from URL if his identity was not known. It means that
+// request was signed with another identity or was not signed at all,
+// so either user have changed his key or somebody pretends to be him.
+// false will be returned if there is no such user.
+func findChangedIdentity(users []userInfo, from protocol.URL, identity ed25519.PublicKey, r network.Resolver) (userInfo, bool) {
+	for _, u := range users {
+		if !u.verified || u.identity.Equal(identity) {
+			continue
+		}
+
+		anonymous := u
+		anonymous.identity = nil
+
+		if isSender(anonymous, from, nil, r) {
+			return u, true
+		}
+	}
+
+	return userInfo{}, false
+}
+
+// movedURL returns URL of user who sent request from URL from.
+//
+// URLs with host name are kept as is, because host
+// name is resolved every time when it is used.
+func movedURL(url protocol.URL, from protocol.URL) protocol.URL {
+	if len(url.Host) != 0 {
+		return url
+	}
+
+	url.Address = from.Address
+	url.Zone = from.Zone
+
+	// older senders don't advertise TCP port
+	if from.Port != 0 {
+		url.Port = from.Port
+	}
+
+	return url
+}
+
+// Content types of requests that carry public key of sender.
+// Receiver of key sends his key back as reply, replies are
+// never answered, so keys are not sent back and forth forever.
+const (
+	contentTypePublicKey      = "application/x-terminal-chat-key"
+	contentTypePublicKeyReply = "application/x-terminal-chat-key-reply"
+)
+
+// handleSendKey sends public key from keys to user
+// using client. room is a room in which user was added.
+// reply is true if key is sent in response to key of user.
+//
+// Nothing will be sent if user doesn't support encryption.
+// Certificate of user is pinned if it wasn't yet.
+// Key is encrypted with secret of room if it is protected.
+func handleSendKey(client *network.Client, keys keyPair, user userInfo, room roomInfo, reply bool) error {
+	fp, err := handlePinCertificate(client, user)
+
+	if err != nil {
+		return err
+	}
+
+	caps, err := client.PeerCapabilities(user.url)
+
+	if err != nil {
+		return err
+	}
+
+	if !caps.Has(protocol.CapEncryption) {
+		return nil
+	}
+
+	payload, encrypted, err := sealRoomPayload(room, append([]byte(nil), keys.public[:]...), false)
+
+	if err != nil {
+		return err
+	}
+
+	// receiver rejects replayed keys using ID and timestamp
+	id, err := network.NewMessageID()
+
+	if err != nil {
+		return err
+	}
+
+	contentType := contentTypePublicKey
+
+	if reply {
+		contentType = contentTypePublicKeyReply
+	}
+
+	req := network.Request{
+		Payload:                payload,
+		Encrypted:              encrypted,
+		ContentType:            contentType,
+		Remote:                 user.url,
+		HandlerLocation:        room.location,
+		CertificateFingerprint: fp,
+		Timestamp:              time.Now(),
+		MessageID:              id,
+	}
+
+	return client.Send(req)
+}
+
+// handlePinCertificate pins TLS certificate of user
+// using client if it wasn't pinned yet.
+//
+// It returns pinned fingerprint that should be used for
+// requests to user, nil for user with not secure URL.
+func handlePinCertificate(client *network.Client, user userInfo) ([]byte, error) {
+	if !user.url.Secure || user.certificate == nil {
+		return nil, nil
+	}
+
+	if fp := user.certificate.get(); fp != nil {
+		return fp, nil
+	}
+
+	cert, err := client.PeerCertificate(user.url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return user.certificate.pin(network.CertificateFingerprint(cert)), nil
+}
+
+// certificateWarning returns error that warns about
+// user whose certificate doesn't match pinned one.
+func certificateWarning(user userInfo, err error) error {
+	return fmt.Errorf(
+		"WARNING: TLS certificate of %v (%v) doesn't match pinned one! Somebody may intercept connection, message was not sent: %w",
+		user.name,
+		user.url.String(),
+		err,
+	)
+}
+
+type handleReceiveKeyInput struct {
+	rooms    roomsState
+	users    usersState
+	from     protocol.URL
+	identity ed25519.PublicKey
+	location uint16
+	key      []byte
+
+	// Whether key is encrypted by sender,
+	// only room secret can be used for that
+	encrypted bool
+
+	// Whether signed key is checked for replay,
+	// only such key can change URL of sender
+	fresh bool
+
+	// Used to resolve host names of users.
+	// nil means default resolver.
+	resolver network.Resolver
+}
+
+var (
+	errInvalidKey = errors.New("received key is invalid")
+	errKeyChanged = errors.New("received key differs from known one, but it is not signed by known identity")
+)
+
+// handleReceiveKey handles receiving of public key from remote user.
+//
+// Key is accepted only from users that exist in destination room,
+// same errors as for handleReceiveText will be returned otherwise.
+// Key should be encrypted with secret of protected room.
+// errInvalidKey will be returned if key is malformed.
+//
+// It returns updated state and user who sent key. changed is
+// true if key wasn't known before, in that case our key
+// should be sent back even if request is replayed.
+//
+// Known key is replaced only if new key is signed by known
+// identity of user, replaced will be true in that case.
+// Otherwise anybody who matches user by address would be able
+// to substitute his own key, so errKeyChanged will be returned.
+func handleReceiveKey(in handleReceiveKeyInput) (users usersState, sender userInfo, changed, replaced bool, err error) {
+	destRoomID, ok := findRoom(in.rooms, in.location)
+
+	if !ok {
+		return in.users, userInfo{}, false, false, errNoDestinationRoom
+	}
+
+	data, boxed, ok := openRoomPayload(in.rooms.started[destRoomID], in.key, in.encrypted)
+
+	if !ok {
+		return in.users, userInfo{}, false, false, errNotAuthenticated
+	}
+
+	// key itself is not encrypted, because
+	// it is needed for encryption
+	if boxed {
+		return in.users, userInfo{}, false, false, errInvalidKey
+	}
+
+	in.key = data
+	added := in.users.added[destRoomID]
+	i, ok := findSender(added, in.from, in.identity, in.resolver)
+
+	if !ok {
+		return in.users, userInfo{}, false, false, errNoUserInDestinationRoom
+	}
+
+	if len(in.key) != keyLength {
+		return in.users, userInfo{}, false, false, errInvalidKey
+	}
+
+	key := [keyLength]byte{}
+	copy(key[:], in.key)
+	changed = added[i].key == nil || *added[i].key != key
+	replaced = changed && added[i].key != nil
+
+	// if identity is known, then it was matched by findSender
+	if replaced && added[i].identity == nil {
+		return in.users, added[i], false, false, errKeyChanged
+	}
+
+	bindSender(added, i, in.from, in.identity, in.fresh)
+
+	if changed {
+		added[i].key = &key
+	}
+
+	return in.users, added[i], changed, replaced, nil
+}
+
+// isSender reports whether user u is a sender with URL from
+// whose request was signed with identity.
+//
+// If identity of user is known, then only identity and location
+// are compared, so address of user doesn't matter and anybody
+// else on that address is rejected.
+//
+// Otherwise full URL is compared, so multiple users on the same
+// host are distinguished. Older senders don't advertise their
+// TCP port, in that case only IP and location are compared.
+// If user have host name, then every cached address of it will be
+// compared. Stale addresses are resolved again in background using r.
+func isSender(u userInfo, from protocol.URL, identity ed25519.PublicKey, r network.Resolver) bool {
+	if u.identity != nil {
+		eq :=
+			u.identity.Equal(identity) &&
+				u.url.Location == from.Location
+
+		return eq
+	}
+
+	urls := []protocol.URL{u.url}
+
+	if len(u.url.Host) != 0 {
+		urls = u.addresses.cached(u.url, r)
+	}
+
+	for _, url := range urls {
+		// received URL have zone only for link-local IPv6,
+		// so zone is ignored in order to not reject users
+		// that were added without zone.
+		eq :=
+			url.IsEqualIP(from) &&
+				url.Location == from.Location &&
+				(from.Port == 0 || url.Port == from.Port)
+
+		if eq {
+			return true
+		}
+	}
+
+	return false
+}
+
 var (
 	errRoomUnavailable = errors.New("unable to retrieve room URL")
 )
@@ -505,16 +1226,17 @@ func handleGetRoomURL(rooms roomsState, port uint16) (string, error) {
 	result := ""
 	outboundWritten := false
 
-	for _, ip := range systemNet {
+	for _, addr := range systemNet {
 		ipType := "local"
 
-		if outbound != nil && outbound.Equal(ip) {
+		if outbound != nil && outbound.Equal(addr.IP) {
 			ipType = "outbound"
 			outboundWritten = true
 		}
 
 		url := protocol.URL{
-			Address:  ip,
+			Address:  addr.IP,
+			Zone:     addr.Zone,
 			Port:     port,
 			Location: info.location,
 		}
@@ -1,11 +1,19 @@
 package chat
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/Amaimersion/terminal-chat/network"
 	"github.com/Amaimersion/terminal-chat/protocol"
 )
 
@@ -154,7 +162,7 @@ func TestHandleStartRoomDifferentLocations(t *testing.T) {
 		}
 	}
 
-	var locations []uint8
+	var locations []uint16
 
 	for _, r := range state.started {
 		for _, l := range locations {
@@ -306,6 +314,21 @@ func TestHandleAddUserNoSuchRoom(t *testing.T) {
 	}
 }
 
+func TestHandleAddUserInvalidURL(t *testing.T) {
+	inpt := handleAddUserInpt
+	inpt.url = "sttp://127.0.0.1:70000/1"
+
+	_, err := handleAddUser(inpt)
+
+	if !errors.Is(err, protocol.ErrInvalidPort) {
+		t.Fatalf("err = %v, want = %v", err, protocol.ErrInvalidPort)
+	}
+
+	if m := handleError(err); !strings.Contains(m, "70000") {
+		t.Errorf("message = %v, want to contain invalid value", m)
+	}
+}
+
 func TestHandleListUsers(t *testing.T) {
 	rooms := roomsState{
 		active:  0,
@@ -485,7 +508,7 @@ func TestHandleSendTextNoReceivers(t *testing.T) {
 	u.added[r.active] = make([]userInfo, 0)
 	tx := handleSendTextInputText
 
-	errs, _ := handleSendText(r, u, tx)
+	errs, _ := handleSendText(&network.Client{}, nil, keyPair{}, r, u, tx)
 
 	for err := range errs {
 		t.Errorf("error = %v, want = no errors at all", err)
@@ -497,7 +520,7 @@ func TestHandleSendTextZeroLength(t *testing.T) {
 	u := handleSendTextInputUsers
 	tx := ""
 
-	errs, _ := handleSendText(r, u, tx)
+	errs, _ := handleSendText(&network.Client{}, nil, keyPair{}, r, u, tx)
 
 	for err := range errs {
 		t.Errorf("error = %v, want = no errors at all", err)
@@ -531,7 +554,7 @@ var handleReceiveTextInpt = handleReceiveTextInput{
 	},
 	from: protocol.URL{
 		Address:  []byte{127, 0, 0, 1},
-		Port:     55687,
+		Port:     3333,
 		Location: 5,
 	},
 	location: 1,
@@ -553,6 +576,20 @@ func TestHandleReceiveText(t *testing.T) {
 	}
 }
 
+func TestHandleReceiveTextSentAt(t *testing.T) {
+	inpt := handleReceiveTextInpt
+	inpt.sentAt = time.Now().Add(-time.Hour)
+	_, msg, err := handleReceiveText(inpt)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if !msg.sentAt.Equal(inpt.sentAt) {
+		t.Errorf("message sent at = %v, want = %v", msg.sentAt, inpt.sentAt)
+	}
+}
+
 func TestHandleReceiveTextNoSuchLocation(t *testing.T) {
 	inpt := handleReceiveTextInpt
 	inpt.location = 2
@@ -586,19 +623,730 @@ func TestHandleReceiveTextInternalText(t *testing.T) {
 	}
 }
 
-// func TestHandleReceiveTextActualizeUser(t *testing.T) {
-// 	inpt := handleReceiveTextInpt
-// 	inpt.from.Location = 6
-//
-// 	users, _, err := handleReceiveText(inpt)
-//
-// 	if err != nil {
-// 		t.Fatalf("err = %v, want = nil", err)
-// 	}
-//
-// 	user := users.added[1][0]
-//
-// 	if user.url.Location != inpt.from.Location {
-// 		t.Errorf("user data wasn't actualized")
-// 	}
-// }
+func TestHandleReceiveTextNotText(t *testing.T) {
+	inpt := handleReceiveTextInpt
+	inpt.contentType = protocol.ContentTypeBinary
+
+	_, _, err := handleReceiveText(inpt)
+
+	if err != errReceivedDataIsNotText {
+		t.Fatalf("err = %v, want = %v", err, errReceivedDataIsNotText)
+	}
+}
+
+func TestHandleReceiveTextSameHostDifferentPort(t *testing.T) {
+	inpt := handleReceiveTextInpt
+	inpt.from.Port = 4444
+
+	_, _, err := handleReceiveText(inpt)
+
+	if err != errNoUserInDestinationRoom {
+		t.Fatalf("err = %v, want = %v", err, errNoUserInDestinationRoom)
+	}
+}
+
+func TestHandleReceiveTextWithoutPort(t *testing.T) {
+	inpt := handleReceiveTextInpt
+	inpt.from.Port = 0
+
+	_, _, err := handleReceiveText(inpt)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+}
+
+// fakeResolver resolves host names using predefined table.
+type fakeResolver map[string][]net.IPAddr
+
+func (r fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	addrs, ok := r[host]
+
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+
+	return addrs, nil
+}
+
+func TestHandleReceiveTextHostName(t *testing.T) {
+	user := userInfo{
+		name: "user1",
+		url: protocol.URL{
+			Host:     "bob.local",
+			Port:     3333,
+			Location: 5,
+		},
+		addresses: &resolvedURLs{},
+	}
+	inpt := handleReceiveTextInpt
+	inpt.users = usersState{
+		added: map[roomID][]userInfo{
+			1: {user},
+		},
+	}
+	inpt.resolver = fakeResolver{
+		"bob.local": {
+			{IP: net.IP{192, 168, 1, 2}},
+			{IP: net.IP{127, 0, 0, 1}},
+		},
+	}
+
+	// not resolved yet
+	_, _, err := handleReceiveText(inpt)
+
+	if err != errNoUserInDestinationRoom {
+		t.Fatalf("err = %v, want = %v", err, errNoUserInDestinationRoom)
+	}
+
+	user.addresses.refresh(user.url, inpt.resolver)
+	_, _, err = handleReceiveText(inpt)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	// cached addresses are used until they are stale
+	inpt.resolver = fakeResolver{
+		"bob.local": {
+			{IP: net.IP{192, 168, 1, 2}},
+		},
+	}
+	user.addresses.refresh(user.url, inpt.resolver)
+	_, _, err = handleReceiveText(inpt)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	user.addresses.resolvedAt = time.Time{}
+	user.addresses.refresh(user.url, inpt.resolver)
+	_, _, err = handleReceiveText(inpt)
+
+	if err != errNoUserInDestinationRoom {
+		t.Fatalf("err = %v, want = %v", err, errNoUserInDestinationRoom)
+	}
+}
+
+// encryptedInput returns copy of handleReceiveTextInpt
+// where sender have sent his public key.
+func encryptedInput(t *testing.T) handleReceiveTextInput {
+	sender, _ := generateKeyPair()
+	receiver, _ := generateKeyPair()
+	user := handleReceiveTextInpt.users.added[1][0]
+	user.key = &sender.public
+
+	inpt := handleReceiveTextInpt
+	inpt.users = usersState{
+		added: map[roomID][]userInfo{
+			1: {user},
+		},
+	}
+	inpt.keys = receiver
+
+	data, err := sender.seal(&receiver.public, []byte(inpt.text))
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	inpt.text = string(data)
+	inpt.encrypted = true
+
+	return inpt
+}
+
+func TestHandleReceiveTextEncrypted(t *testing.T) {
+	inpt := encryptedInput(t)
+	_, msg, err := handleReceiveText(inpt)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if want := handleReceiveTextInpt.text; msg.text != want {
+		t.Errorf("message text = %v, want = %v", msg.text, want)
+	}
+}
+
+func TestHandleReceiveTextPlainFromUserWithKey(t *testing.T) {
+	inpt := encryptedInput(t)
+	inpt.text = handleReceiveTextInpt.text
+	inpt.encrypted = false
+
+	_, _, err := handleReceiveText(inpt)
+
+	if err != errReceivedTextIsPlain {
+		t.Fatalf("err = %v, want = %v", err, errReceivedTextIsPlain)
+	}
+}
+
+func TestHandleReceiveTextUnableToDecrypt(t *testing.T) {
+	inpt := encryptedInput(t)
+	other, _ := generateKeyPair()
+	inpt.keys = other
+
+	_, _, err := handleReceiveText(inpt)
+
+	if err != errUnableToDecrypt {
+		t.Fatalf("err = %v, want = %v", err, errUnableToDecrypt)
+	}
+
+	inpt = handleReceiveTextInpt
+	inpt.encrypted = true
+
+	_, _, err = handleReceiveText(inpt)
+
+	if err != errUnableToDecrypt {
+		t.Fatalf("without key: err = %v, want = %v", err, errUnableToDecrypt)
+	}
+}
+
+func TestHandleReceiveKey(t *testing.T) {
+	keys, _ := generateKeyPair()
+	inpt := handleReceiveKeyInput{
+		rooms: handleReceiveTextInpt.rooms,
+		users: usersState{
+			added: map[roomID][]userInfo{
+				1: {handleReceiveTextInpt.users.added[1][0]},
+			},
+		},
+		from:     handleReceiveTextInpt.from,
+		location: handleReceiveTextInpt.location,
+		key:      keys.public[:],
+	}
+	users, sender, changed, replaced, err := handleReceiveKey(inpt)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if replaced {
+		t.Errorf("replaced = %v, want = %v", replaced, false)
+	}
+
+	if !changed {
+		t.Errorf("changed = %v, want = %v", changed, true)
+	}
+
+	if sender.name != "user1" {
+		t.Errorf("sender = %v, want = user1", sender.name)
+	}
+
+	if k := users.added[1][0].key; k == nil || *k != keys.public {
+		t.Errorf("key = %v, want = %v", k, keys.public)
+	}
+
+	inpt.users = users
+	_, _, changed, _, err = handleReceiveKey(inpt)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if changed {
+		t.Errorf("same key: changed = %v, want = %v", changed, false)
+	}
+}
+
+func TestHandleReceiveKeyReplaced(t *testing.T) {
+	oldKeys, _ := generateKeyPair()
+	newKeys, _ := generateKeyPair()
+	identity, _, _ := ed25519.GenerateKey(nil)
+	user := handleReceiveTextInpt.users.added[1][0]
+	user.key = &oldKeys.public
+	inpt := handleReceiveKeyInput{
+		rooms: handleReceiveTextInpt.rooms,
+		users: usersState{
+			added: map[roomID][]userInfo{
+				1: {user},
+			},
+		},
+		from:     handleReceiveTextInpt.from,
+		identity: identity,
+		location: handleReceiveTextInpt.location,
+		key:      newKeys.public[:],
+	}
+	users, _, _, replaced, err := handleReceiveKey(inpt)
+
+	if err != errKeyChanged {
+		t.Fatalf("unknown identity: err = %v, want = %v", err, errKeyChanged)
+	}
+
+	if replaced {
+		t.Errorf("unknown identity: replaced = %v, want = %v", replaced, false)
+	}
+
+	if u := users.added[1][0]; *u.key != oldKeys.public || u.identity != nil {
+		t.Errorf("unknown identity: user = %v, want unchanged", u)
+	}
+
+	inpt.users.added[1][0].identity = identity
+	users, _, changed, replaced, err := handleReceiveKey(inpt)
+
+	if err != nil {
+		t.Fatalf("known identity: err = %v, want = nil", err)
+	}
+
+	if !changed || !replaced {
+		t.Errorf("known identity: changed = %v, replaced = %v, want = true", changed, replaced)
+	}
+
+	if k := users.added[1][0].key; *k != newKeys.public {
+		t.Errorf("known identity: key = %v, want = %v", k, newKeys.public)
+	}
+}
+
+func TestHandleReceiveKeyInvalid(t *testing.T) {
+	inpt := handleReceiveKeyInput{
+		rooms:    handleReceiveTextInpt.rooms,
+		users:    handleReceiveTextInpt.users,
+		from:     handleReceiveTextInpt.from,
+		location: handleReceiveTextInpt.location,
+		key:      []byte("key"),
+	}
+	_, _, _, _, err := handleReceiveKey(inpt)
+
+	if err != errInvalidKey {
+		t.Fatalf("err = %v, want = %v", err, errInvalidKey)
+	}
+
+	inpt.from.Address = []byte{192, 168, 1, 235}
+	_, _, _, _, err = handleReceiveKey(inpt)
+
+	if err != errNoUserInDestinationRoom {
+		t.Fatalf("err = %v, want = %v", err, errNoUserInDestinationRoom)
+	}
+}
+
+// startUserServer starts server of remote user on random local
+// port. Requests that arrive to server are sent to returned
+// channel. Caller should shut server down.
+func startUserServer(t *testing.T, server *network.Server) (protocol.URL, <-chan network.Request) {
+	requests := make(chan network.Request, 10)
+	server.HandleAll(func(req network.Request) {
+		requests <- req
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	go server.Serve(listener)
+
+	addr := listener.Addr().(*net.TCPAddr)
+	url := protocol.URL{
+		Address: addr.IP,
+		Port:    uint16(addr.Port),
+	}
+
+	return url, requests
+}
+
+func TestHandleSendTextEncrypted(t *testing.T) {
+	server := network.Server{
+		Capabilities: protocol.CapEncryption,
+	}
+	url, requests := startUserServer(t, &server)
+	defer server.Shutdown(context.Background())
+
+	client := &network.Client{
+		Handshake: true,
+	}
+	defer client.Close()
+
+	sender, _ := generateKeyPair()
+	receiver, _ := generateKeyPair()
+	url.Location = 5
+	user := userInfo{
+		name: "user1",
+		url:  url,
+		key:  &receiver.public,
+	}
+	rooms := handleSendTextInputRooms
+	users := usersState{
+		added: map[roomID][]userInfo{
+			rooms.active: {user},
+		},
+	}
+	errs, _ := handleSendText(client, nil, sender, rooms, users, "text")
+
+	for err := range errs {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	req := <-requests
+
+	if !req.Encrypted {
+		t.Fatalf("encrypted = %v, want = %v", req.Encrypted, true)
+	}
+
+	text, ok := receiver.open(&sender.public, req.Payload)
+
+	if !ok || string(text) != "text" {
+		t.Errorf("decrypted text = %q, ok = %v, want = text", text, ok)
+	}
+}
+
+func TestHandleReceiveTextIdentity(t *testing.T) {
+	identity, _, _ := ed25519.GenerateKey(nil)
+	impostor, _, _ := ed25519.GenerateKey(nil)
+	inpt := handleReceiveTextInpt
+	inpt.users = usersState{
+		added: map[roomID][]userInfo{
+			1: {handleReceiveTextInpt.users.added[1][0]},
+		},
+	}
+	inpt.identity = identity
+
+	users, _, err := handleReceiveText(inpt)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if u := users.added[1][0]; !u.identity.Equal(identity) {
+		t.Fatalf("identity = %v, want = %v", u.identity, identity)
+	}
+
+	// IP address of user has been changed
+	moved := inpt
+	moved.users = users
+	moved.from.Address = []byte{192, 168, 1, 235}
+	moved.from.Port = 4444
+
+	// it can be replayed request
+	users, _, err = handleReceiveText(moved)
+
+	if err != nil {
+		t.Fatalf("not fresh: err = %v, want = nil", err)
+	}
+
+	if u := users.added[1][0]; !u.url.IsEqual(inpt.from) {
+		t.Errorf("not fresh: url = %v, want = %v", u.url, inpt.from)
+	}
+
+	moved.users = users
+	moved.fresh = true
+	users, msg, err := handleReceiveText(moved)
+
+	if err != nil {
+		t.Fatalf("moved: err = %v, want = nil", err)
+	}
+
+	if msg.from != "user1" {
+		t.Errorf("moved: sender = %v, want = user1", msg.from)
+	}
+
+	if u := users.added[1][0]; !u.url.IsEqual(moved.from) {
+		t.Errorf("moved: url = %v, want = %v", u.url, moved.from)
+	}
+
+	// somebody else uses old IP address
+	for _, id := range []ed25519.PublicKey{nil, impostor} {
+		old := inpt
+		old.users = users
+		old.identity = id
+
+		_, _, err = handleReceiveText(old)
+
+		if err != errNoUserInDestinationRoom {
+			t.Errorf("impostor %v: err = %v, want = %v", id, err, errNoUserInDestinationRoom)
+		}
+	}
+}
+
+func TestHandleSendTextPinnedCertificate(t *testing.T) {
+	cert, err := loadCertificate(t.TempDir())
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	server := network.Server{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+	url, requests := startUserServer(t, &server)
+	defer server.Shutdown(context.Background())
+
+	client := &network.Client{
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+	defer client.Close()
+
+	url.Secure = true
+	user := userInfo{
+		name:        "user1",
+		url:         url,
+		certificate: &certificatePin{},
+	}
+	rooms := handleSendTextInputRooms
+	users := usersState{
+		added: map[roomID][]userInfo{
+			rooms.active: {user},
+		},
+	}
+	errs, _ := handleSendText(client, nil, keyPair{}, rooms, users, "text")
+
+	for err := range errs {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if req := <-requests; !req.Remote.Secure {
+		t.Errorf("secure = %v, want = %v", req.Remote.Secure, true)
+	}
+
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	want := network.CertificateFingerprint(leaf)
+
+	if fp := user.certificate.get(); !bytes.Equal(fp, want) {
+		t.Fatalf("pinned = %v, want = %v", fp, want)
+	}
+
+	users.added[rooms.active][0].certificate = &certificatePin{
+		fingerprint: make([]byte, len(want)),
+	}
+	errs, _ = handleSendText(client, nil, keyPair{}, rooms, users, "text")
+	err = <-errs
+
+	if !errors.Is(err, network.ErrCertificateMismatch) {
+		t.Errorf("err = %v, want = %v", err, network.ErrCertificateMismatch)
+	}
+}
+
+func TestHandleVerifyUser(t *testing.T) {
+	ours, _, _ := ed25519.GenerateKey(nil)
+	theirs, _, _ := ed25519.GenerateKey(nil)
+	rooms := handleReceiveTextInpt.rooms
+	user := handleReceiveTextInpt.users.added[1][0]
+	users := usersState{
+		added: map[roomID][]userInfo{
+			1: {user},
+		},
+	}
+
+	if _, err := handleVerifyUser(rooms, users, "user2", ours); err != errNoSuchUser {
+		t.Errorf("err = %v, want = %v", err, errNoSuchUser)
+	}
+
+	if _, err := handleVerifyUser(rooms, users, "user1", ours); err != errUnknownIdentity {
+		t.Errorf("err = %v, want = %v", err, errUnknownIdentity)
+	}
+
+	if _, err := handleTrustUser(rooms, users, "user1"); err != errUnknownIdentity {
+		t.Errorf("err = %v, want = %v", err, errUnknownIdentity)
+	}
+
+	users.added[1][0].identity = theirs
+	m, err := handleVerifyUser(rooms, users, "user1", ours)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if n := safetyNumber(ours, theirs); !strings.Contains(m, n) {
+		t.Errorf("message = %v, want to contain %v", m, n)
+	}
+
+	users, err = handleTrustUser(rooms, users, "user1")
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if !users.added[1][0].verified {
+		t.Errorf("verified = %v, want = %v", false, true)
+	}
+
+	if m := handleListUsers(rooms, users); !strings.Contains(m, "verified") {
+		t.Errorf("users = %v, want to contain verified state", m)
+	}
+}
+
+func TestFindChangedIdentity(t *testing.T) {
+	identity, _, _ := ed25519.GenerateKey(nil)
+	impostor, _, _ := ed25519.GenerateKey(nil)
+	from := handleReceiveTextInpt.from
+	user := handleReceiveTextInpt.users.added[1][0]
+	user.identity = identity
+	users := []userInfo{user}
+
+	if _, ok := findChangedIdentity(users, from, impostor, nil); ok {
+		t.Errorf("not verified: ok = %v, want = %v", ok, false)
+	}
+
+	users[0].verified = true
+
+	for _, id := range []ed25519.PublicKey{nil, impostor} {
+		if u, ok := findChangedIdentity(users, from, id, nil); !ok || u.name != user.name {
+			t.Errorf("%v: user = %v, ok = %v, want = %v", id, u.name, ok, user.name)
+		}
+	}
+
+	if _, ok := findChangedIdentity(users, from, identity, nil); ok {
+		t.Errorf("same identity: ok = %v, want = %v", ok, false)
+	}
+
+	other := from
+	other.Port++
+
+	if _, ok := findChangedIdentity(users, other, impostor, nil); ok {
+		t.Errorf("other URL: ok = %v, want = %v", ok, false)
+	}
+}
+
+// protectedInput returns copy of handleReceiveTextInpt
+// whose destination room is protected with passphrase.
+func protectedInput(t *testing.T, passphrase string) handleReceiveTextInput {
+	rooms, err := handleProtectRoom(
+		roomsState{
+			active:  1,
+			nextNew: 2,
+			started: map[roomID]roomInfo{
+				1: handleReceiveTextInpt.rooms.started[1],
+			},
+		},
+		passphrase,
+	)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	inpt := handleReceiveTextInpt
+	inpt.rooms = rooms
+
+	return inpt
+}
+
+func TestHandleReceiveTextProtectedRoom(t *testing.T) {
+	inpt := protectedInput(t, "secret")
+	payload, _, err := sealRoomPayload(inpt.rooms.started[1], []byte(inpt.text), false)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	authentic := inpt
+	authentic.text = string(payload)
+	authentic.encrypted = true
+	_, msg, err := handleReceiveText(authentic)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if msg.text != inpt.text {
+		t.Errorf("text = %v, want = %v", msg.text, inpt.text)
+	}
+
+	if _, _, err := handleReceiveText(inpt); err != errNotAuthenticated {
+		t.Errorf("plain: err = %v, want = %v", err, errNotAuthenticated)
+	}
+
+	other := protectedInput(t, "other secret")
+	other.text = authentic.text
+	other.encrypted = true
+
+	if _, _, err := handleReceiveText(other); err != errNotAuthenticated {
+		t.Errorf("other secret: err = %v, want = %v", err, errNotAuthenticated)
+	}
+}
+
+func TestHandleReceiveTextProtectedRoomBoxed(t *testing.T) {
+	inpt := protectedInput(t, "secret")
+	sender, _ := generateKeyPair()
+	receiver, _ := generateKeyPair()
+	inpt.keys = receiver
+
+	// sender knows our key, but we don't know his key yet
+	boxed, err := sender.seal(&receiver.public, []byte(inpt.text))
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	payload, _, err := sealRoomPayload(inpt.rooms.started[1], boxed, true)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	inpt.text = string(payload)
+	inpt.encrypted = true
+
+	if _, _, err := handleReceiveText(inpt); err != errUnableToDecrypt {
+		t.Fatalf("unknown key: err = %v, want = %v", err, errUnableToDecrypt)
+	}
+
+	inpt.users = usersState{
+		added: map[roomID][]userInfo{
+			1: {handleReceiveTextInpt.users.added[1][0]},
+		},
+	}
+	inpt.users.added[1][0].key = &sender.public
+	_, msg, err := handleReceiveText(inpt)
+
+	if err != nil {
+		t.Fatalf("known key: err = %v, want = nil", err)
+	}
+
+	if msg.text != handleReceiveTextInpt.text {
+		t.Errorf("known key: text = %v, want = %v", msg.text, handleReceiveTextInpt.text)
+	}
+}
+
+func TestHandleListRoomsProtected(t *testing.T) {
+	inpt := protectedInput(t, "secret")
+	m := handleListRooms(inpt.rooms, inpt.users)
+
+	if !strings.Contains(m, "protected") {
+		t.Errorf("rooms = %v, want to contain protected state", m)
+	}
+}
+
+func TestIsAckAuthentic(t *testing.T) {
+	inpt := protectedInput(t, "secret")
+	room := inpt.rooms.started[1]
+	payload, _, err := sealRoomPayload(room, ackPayload(5), false)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	ack := network.Request{
+		Ack:             true,
+		MessageID:       5,
+		Payload:         payload,
+		Encrypted:       true,
+		HandlerLocation: room.location,
+	}
+
+	if !isAckAuthentic(inpt.rooms, ack) {
+		t.Errorf("authentic = %v, want = %v", false, true)
+	}
+
+	forged := ack
+	forged.MessageID = 6
+
+	if isAckAuthentic(inpt.rooms, forged) {
+		t.Errorf("other ID: authentic = %v, want = %v", true, false)
+	}
+
+	plain := ack
+	plain.Payload = nil
+	plain.Encrypted = false
+
+	if isAckAuthentic(inpt.rooms, plain) {
+		t.Errorf("plain: authentic = %v, want = %v", true, false)
+	}
+
+	if !isAckAuthentic(handleReceiveTextInpt.rooms, plain) {
+		t.Errorf("not protected room: authentic = %v, want = %v", false, true)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"io"
 	"strings"
+
+	"github.com/Amaimersion/terminal-chat/protocol"
 )
 
 // command is a template of user input that intended only to the program.
@@ -50,8 +52,20 @@ var (
 		text:      "/del_user",
 		argsCount: 1,
 	}
+	commandVerifyUser = command{
+		text:      "/verify",
+		argsCount: 1,
+	}
+	commandTrustUser = command{
+		text:      "/trust",
+		argsCount: 1,
+	}
 )
 
+// Option of commandStartRoom that protects room with passphrase.
+// Passphrase is everything after option, so it may contain spaces.
+const optionSecret = "--secret"
+
 // input is a parsed and structured user input.
 type input struct {
 	command command
@@ -66,6 +80,12 @@ func (a input) isEqual(b input) bool {
 	return equal
 }
 
+const (
+	// Long text may be pasted as single line, so line should
+	// fit longest message that can be sent.
+	maxInputLineLength = protocol.DefaultMaxMessageLength + 1024
+)
+
 var (
 	errInvalidInput = errors.New("invalid input")
 )
@@ -75,6 +95,7 @@ var (
 // If input is valid, then it will be sended to ch.
 func readInput(r io.Reader, ch chan<- input) error {
 	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxInputLineLength)
 
 	for scanner.Scan() {
 		t := scanner.Text()
@@ -134,8 +155,16 @@ func deconstructInput(i string) (c command, args []string, err error) {
 			i,
 			commandStartRoom.text,
 			commandStartRoom.argsCount,
-		); args != nil {
-			return commandStartRoom, args, nil
+		); args != nil && args[0] != optionSecret {
+			secret, ok := extractInputOption(i, optionSecret)
+
+			if !ok {
+				return commandStartRoom, args, nil
+			}
+
+			if len(secret) != 0 {
+				return commandStartRoom, append(args, secret), nil
+			}
 		}
 	} else if strings.HasPrefix(i, commandDeleteRoom.text) {
 		if args := extractInputArgs(
@@ -169,6 +198,22 @@ func deconstructInput(i string) (c command, args []string, err error) {
 		); args != nil {
 			return commandDeleteUser, args, nil
 		}
+	} else if strings.HasPrefix(i, commandVerifyUser.text) {
+		if args := extractInputArgs(
+			i,
+			commandVerifyUser.text,
+			commandVerifyUser.argsCount,
+		); args != nil {
+			return commandVerifyUser, args, nil
+		}
+	} else if strings.HasPrefix(i, commandTrustUser.text) {
+		if args := extractInputArgs(
+			i,
+			commandTrustUser.text,
+			commandTrustUser.argsCount,
+		); args != nil {
+			return commandTrustUser, args, nil
+		}
 	} else if len(i) > 0 {
 		return commandSendText, []string{i}, nil
 	}
@@ -199,3 +244,20 @@ func extractInputArgs(i, trimPrefix string, argsCount int) []string {
 
 	return args
 }
+
+// extractInputOption extracts value of option from input.
+// Value is everything after option, leading and trailing
+// spaces are trimmed. false will be returned if input
+// doesn't have such option.
+func extractInputOption(i, option string) (string, bool) {
+	index := strings.Index(i, " "+option+" ")
+
+	if index == -1 {
+		return "", strings.HasSuffix(i, " "+option)
+	}
+
+	value := i[index+len(option)+2:]
+	value = strings.TrimSpace(value)
+
+	return value, true
+}
@@ -87,6 +87,16 @@ func TestReadInputPlainText(t *testing.T) {
 	testReadInput(t, in, want)
 }
 
+func TestReadInputLongText(t *testing.T) {
+	in := strings.Repeat("a", 100*1024)
+	want := input{
+		command: commandSendText,
+		args:    []string{in},
+	}
+
+	testReadInput(t, in, want)
+}
+
 func TestReadInputExitCommand(t *testing.T) {
 	in := commandExit.text
 	want := input{
@@ -249,3 +259,33 @@ func TestExtractInputArgsMissingPrefix(t *testing.T) {
 
 	testExtractInputArgs(t, in, trimPrefix, argsCount, wantArgs, false)
 }
+
+func TestDeconstructInputVerifyUserCommand(t *testing.T) {
+	in := commandVerifyUser.text + " name"
+	wantCommand := commandVerifyUser
+	wantArgs := []string{"name"}
+
+	testDeconstructInput(t, in, wantCommand, wantArgs)
+}
+
+func TestDeconstructInputStartRoomSecret(t *testing.T) {
+	in := commandStartRoom.text + " name " + optionSecret + " long pass phrase "
+	wantCommand := commandStartRoom
+	wantArgs := []string{"name", "long pass phrase"}
+
+	testDeconstructInput(t, in, wantCommand, wantArgs)
+}
+
+func TestDeconstructInputStartRoomEmptySecret(t *testing.T) {
+	inputs := []string{
+		commandStartRoom.text + " name " + optionSecret,
+		commandStartRoom.text + " name " + optionSecret + "  ",
+		commandStartRoom.text + " " + optionSecret + " passphrase",
+	}
+
+	for _, in := range inputs {
+		if _, _, err := deconstructInput(in); err != errInvalidInput {
+			t.Errorf("%q: err = %v, want = %v", in, err, errInvalidInput)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// Length of X25519 keys.
+	keyLength = 32
+
+	// Length of random nonce that is prepended
+	// to every encrypted payload.
+	nonceLength = 24
+
+	// Names of files in config directory
+	// where private keys are kept.
+	keyFileName      = "encryption.key"
+	identityFileName = "identity.key"
+
+	// Safety number consists of that many
+	// groups of 5 decimal digits.
+	safetyNumberGroups = 6
+
+	// Parameters of scrypt for derivation of room keys.
+	// Both sides should derive the same key from passphrase,
+	// so salt is fixed.
+	roomKeySalt = "terminal-chat room secret v1"
+	roomKeyN    = 1 << 15
+	roomKeyR    = 8
+	roomKeyP    = 1
+)
+
+// keyPair is a long-term X25519 key pair of chat instance.
+//
+// Public key is sent to users when they are added,
+// private key never leaves config directory.
+type keyPair struct {
+	public  [keyLength]byte
+	private [keyLength]byte
+}
+
+var (
+	errInvalidKeyFile = errors.New("key file is corrupted")
+)
+
+// generateKeyPair returns new random key pair.
+func generateKeyPair() (keyPair, error) {
+	public, private, err := box.GenerateKey(rand.Reader)
+
+	if err != nil {
+		return keyPair{}, err
+	}
+
+	keys := keyPair{
+		public:  *public,
+		private: *private,
+	}
+
+	return keys, nil
+}
+
+// loadKeyPair reads key pair from dir.
+//
+// If dir doesn't have key pair, then new one will
+// be generated and saved. errInvalidKeyFile will be
+// returned if existing key file is corrupted.
+func loadKeyPair(dir string) (keyPair, error) {
+	private, err := loadKeyFile(filepath.Join(dir, keyFileName))
+
+	if err != nil {
+		return keyPair{}, err
+	}
+
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+
+	if err != nil {
+		return keyPair{}, errInvalidKeyFile
+	}
+
+	keys := keyPair{}
+	copy(keys.private[:], private)
+	copy(keys.public[:], public)
+
+	return keys, nil
+}
+
+// loadIdentity reads Ed25519 identity key from dir.
+//
+// It is similar to loadKeyPair, but identity key is used
+// for signing of requests. Remote users identify us by
+// public part of this key.
+func loadIdentity(dir string) (ed25519.PrivateKey, error) {
+	seed, err := loadKeyFile(filepath.Join(dir, identityFileName))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// loadKeyFile reads keyLength bytes of private key from path.
+//
+// If there is no such file, then random key will be generated
+// and saved. Only current OS user is allowed to read saved key.
+func loadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+
+	if err == nil {
+		if len(data) != keyLength {
+			return nil, errInvalidKeyFile
+		}
+
+		return data, nil
+	}
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	data = make([]byte, keyLength)
+
+	if _, err := rand.Read(data); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// fingerprint returns short human readable
+// representation of public identity key.
+func fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return formatFingerprint(sum[:])
+}
+
+// formatFingerprint returns short human readable
+// representation of hash sum.
+func formatFingerprint(sum []byte) string {
+	s := hex.EncodeToString(sum[:8])
+	return s[0:4] + " " + s[4:8] + " " + s[8:12] + " " + s[12:16]
+}
+
+// safetyNumber returns number that is the same for both owners
+// of identity keys a and b. They can compare it out of band in
+// order to make sure that nobody pretends to be one of them.
+func safetyNumber(a, b ed25519.PublicKey) string {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+
+	h := sha512.New()
+	h.Write([]byte("terminal-chat safety number v1"))
+	h.Write(a)
+	h.Write(b)
+	sum := h.Sum(nil)
+	groups := make([]string, 0, safetyNumberGroups)
+
+	for i := 0; i < safetyNumberGroups; i++ {
+		n := binary.BigEndian.Uint64(sum[i*8:]) % 100000
+		groups = append(groups, fmt.Sprintf("%05d", n))
+	}
+
+	return strings.Join(groups, " ")
+}
+
+// seal encrypts and authenticates msg for owner of peerKey.
+// Random nonce is prepended to result.
+func (k keyPair) seal(peerKey *[keyLength]byte, msg []byte) ([]byte, error) {
+	var nonce [nonceLength]byte
+
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+
+	return box.Seal(nonce[:], msg, &nonce, peerKey, &k.private), nil
+}
+
+// open decrypts data that was sealed by owner of peerKey.
+// false will be returned if data can't be authenticated.
+func (k keyPair) open(peerKey *[keyLength]byte, data []byte) ([]byte, bool) {
+	if len(data) < nonceLength {
+		return nil, false
+	}
+
+	var nonce [nonceLength]byte
+	copy(nonce[:], data)
+
+	return box.Open(nil, data[nonceLength:], &nonce, peerKey, &k.private)
+}
+
+// deriveRoomKey returns room key that is derived
+// from passphrase using scrypt.
+func deriveRoomKey(passphrase string) (*[keyLength]byte, error) {
+	data, err := scrypt.Key(
+		[]byte(passphrase),
+		[]byte(roomKeySalt),
+		roomKeyN,
+		roomKeyR,
+		roomKeyP,
+		keyLength,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key := [keyLength]byte{}
+	copy(key[:], data)
+
+	return &key, nil
+}
+
+// sealSecret encrypts and authenticates msg using room key.
+// Random nonce is prepended to result.
+func sealSecret(key *[keyLength]byte, msg []byte) ([]byte, error) {
+	var nonce [nonceLength]byte
+
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+
+	return secretbox.Seal(nonce[:], msg, &nonce, key), nil
+}
+
+// openSecret decrypts data that was sealed using room key.
+// false will be returned if data can't be authenticated.
+func openSecret(key *[keyLength]byte, data []byte) ([]byte, bool) {
+	if len(data) < nonceLength {
+		return nil, false
+	}
+
+	var nonce [nonceLength]byte
+	copy(nonce[:], data)
+
+	return secretbox.Open(nil, data[nonceLength:], &nonce, key)
+}
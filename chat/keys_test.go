@@ -0,0 +1,159 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadKeyPair(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "config")
+	keys, err := loadKeyPair(dir)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	loaded, err := loadKeyPair(dir)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if loaded != keys {
+		t.Errorf("loaded keys are different from saved keys")
+	}
+}
+
+func TestLoadIdentity(t *testing.T) {
+	dir := t.TempDir()
+	key, err := loadIdentity(dir)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	loaded, err := loadIdentity(dir)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if !loaded.Equal(key) {
+		t.Errorf("loaded identity is different from saved identity")
+	}
+}
+
+func TestLoadKeyPairCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, keyFileName)
+
+	if err := os.WriteFile(path, []byte("key"), 0600); err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	_, err := loadKeyPair(dir)
+
+	if err != errInvalidKeyFile {
+		t.Errorf("err = %v, want = %v", err, errInvalidKeyFile)
+	}
+}
+
+func TestKeyPairSealOpen(t *testing.T) {
+	alice, _ := generateKeyPair()
+	bob, _ := generateKeyPair()
+	msg := []byte("text")
+	data, err := alice.seal(&bob.public, msg)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	result, ok := bob.open(&alice.public, data)
+
+	if !ok {
+		t.Fatalf("ok = %v, want = %v", ok, true)
+	}
+
+	if !bytes.Equal(result, msg) {
+		t.Errorf("result = %v, want = %v", result, msg)
+	}
+
+	data[len(data)-1] ^= 1
+
+	if _, ok := bob.open(&alice.public, data); ok {
+		t.Errorf("tampered data: ok = %v, want = %v", ok, false)
+	}
+
+	if _, ok := bob.open(&alice.public, data[:nonceLength-1]); ok {
+		t.Errorf("short data: ok = %v, want = %v", ok, false)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	public := key.Public().(ed25519.PublicKey)
+	s := fingerprint(public)
+
+	if len(s) != 19 {
+		t.Errorf("fingerprint = %v, want 4 groups of 4 digits", s)
+	}
+
+	if other := fingerprint(public[:31]); other == s {
+		t.Errorf("different keys have same fingerprint %v", s)
+	}
+}
+
+func TestSafetyNumber(t *testing.T) {
+	alice, _, _ := ed25519.GenerateKey(nil)
+	bob, _, _ := ed25519.GenerateKey(nil)
+	mallory, _, _ := ed25519.GenerateKey(nil)
+	n := safetyNumber(alice, bob)
+
+	if len(n) != safetyNumberGroups*6-1 {
+		t.Errorf("safety number = %v, want %v groups of 5 digits", n, safetyNumberGroups)
+	}
+
+	if other := safetyNumber(bob, alice); other != n {
+		t.Errorf("reversed = %v, want = %v", other, n)
+	}
+
+	if other := safetyNumber(alice, mallory); other == n {
+		t.Errorf("different keys have same safety number %v", n)
+	}
+}
+
+func TestDeriveRoomKey(t *testing.T) {
+	key, err := deriveRoomKey("secret")
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	same, _ := deriveRoomKey("secret")
+	other, _ := deriveRoomKey("other secret")
+
+	if *same != *key {
+		t.Errorf("same passphrase gives different keys")
+	}
+
+	if *other == *key {
+		t.Errorf("different passphrases give same key")
+	}
+
+	data, err := sealSecret(key, []byte("text"))
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if _, ok := openSecret(other, data); ok {
+		t.Errorf("other key: ok = %v, want = %v", ok, false)
+	}
+
+	if result, ok := openSecret(key, data); !ok || string(result) != "text" {
+		t.Errorf("result = %q, ok = %v, want = text", result, ok)
+	}
+}
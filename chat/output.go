@@ -75,7 +75,15 @@ func writeWithFormat(w io.Writer, s string, flag int) error {
 type message struct {
 	text string
 	room string
-	at   time.Time
+
+	// When message was composed for outgoing messages,
+	// or when it was received for received messages.
+	at time.Time
+
+	// When message was written by sender according
+	// to clock of sender. Zero means that it is unknown,
+	// in that case at is shown instead.
+	sentAt time.Time
 
 	// If outgoing is true, then this value may be omitted.
 	from string
@@ -85,8 +93,14 @@ type message struct {
 	outgoing bool
 }
 
+const (
+	// Difference between send and receive time above that
+	// is shown to user, because shown time may be wrong.
+	maxClockSkew = time.Minute
+)
+
 func (m message) string() string {
-	t := m.at.Format("15:04")
+	t := m.timeString()
 	s := ""
 
 	if m.outgoing {
@@ -108,3 +122,58 @@ func (m message) string() string {
 
 	return s
 }
+
+// timeString returns time when message was written.
+// Noticeable clock skew is shown along with time.
+func (m message) timeString() string {
+	if m.sentAt.IsZero() {
+		return m.at.Format("15:04")
+	}
+
+	s := m.sentAt.Format("15:04")
+	skew := m.at.Sub(m.sentAt)
+
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		sign := "+"
+
+		if skew < 0 {
+			sign = "-"
+			skew = -skew
+		}
+
+		s += fmt.Sprintf(" (clock skew %v%v)", sign, skew.Round(time.Second))
+	}
+
+	return s
+}
+
+const (
+	// Texts that are longer will be shortened in delivery reports.
+	maxDeliveryTextLength = 30
+)
+
+// deliveryString returns report about delivery
+// of message to user.
+func deliveryString(d delivery, delivered bool) string {
+	state := "delivered"
+
+	if !delivered {
+		state = "not delivered"
+	}
+
+	text := []rune(d.text)
+
+	if len(text) > maxDeliveryTextLength {
+		text = append(text[:maxDeliveryTextLength], []rune("...")...)
+	}
+
+	s := fmt.Sprintf(
+		"%v %v to %v: %v",
+		d.room,
+		state,
+		d.user.name,
+		string(text),
+	)
+
+	return s
+}
@@ -34,3 +34,53 @@ func TestMessageString(t *testing.T) {
 		t.Errorf("result string is empty")
 	}
 }
+
+func TestMessageStringSentAt(t *testing.T) {
+	sentAt := time.Date(2021, 1, 1, 10, 30, 0, 0, time.Local)
+	m := message{
+		text:   "text",
+		room:   "room",
+		at:     sentAt.Add(time.Second * 5),
+		sentAt: sentAt,
+		from:   "from",
+	}
+	s := m.string()
+	want := "> 10:30 room from: text"
+
+	if s != want {
+		t.Errorf("result = %v, want = %v", s, want)
+	}
+}
+
+func TestMessageStringClockSkew(t *testing.T) {
+	sentAt := time.Date(2021, 1, 1, 10, 30, 0, 0, time.Local)
+	m := message{
+		text:   "text",
+		room:   "room",
+		at:     sentAt.Add(-time.Minute * 5),
+		sentAt: sentAt,
+		from:   "from",
+	}
+	s := m.string()
+	want := "> 10:30 (clock skew -5m0s) room from: text"
+
+	if s != want {
+		t.Errorf("result = %v, want = %v", s, want)
+	}
+}
+
+func TestMessageStringWithoutSentAt(t *testing.T) {
+	at := time.Date(2021, 1, 1, 10, 30, 0, 0, time.Local)
+	m := message{
+		text: "text",
+		room: "room",
+		at:   at,
+		from: "from",
+	}
+	s := m.string()
+	want := "> 10:30 room from: text"
+
+	if s != want {
+		t.Errorf("result = %v, want = %v", s, want)
+	}
+}
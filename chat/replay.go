@@ -0,0 +1,79 @@
+package chat
+
+import (
+	"crypto/ed25519"
+	"sync"
+	"time"
+)
+
+// How far timestamp of signed request can be from
+// local time. Requests outside of that window are
+// rejected, so they can't be replayed later.
+const replayWindow = time.Minute * 5
+
+// replayKey identifies signed request. Sender uses the same
+// ID for all users of room, so several rooms can receive
+// request with the same ID.
+type replayKey struct {
+	identity string
+	id       uint64
+	location uint16
+}
+
+// replayGuard rejects signed requests that were already
+// received or were sent too long ago.
+//
+// Signature covers message ID and timestamp, so they
+// can't be changed by somebody who replays request.
+// replayGuard is safe for concurrent use.
+type replayGuard struct {
+	// How far timestamp can be from local time.
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[replayKey]time.Time
+}
+
+func newReplayGuard(window time.Duration) *replayGuard {
+	g := &replayGuard{
+		window: window,
+		seen:   make(map[replayKey]time.Time),
+	}
+
+	return g
+}
+
+// check reports whether request with id that was signed with
+// identity at sentAt is received first time by room with location
+// and sentAt is within window around now. Accepted request is
+// remembered, so it will be rejected next time.
+func (g *replayGuard) check(identity ed25519.PublicKey, id uint64, location uint16, sentAt, now time.Time) bool {
+	if sentAt.Before(now.Add(-g.window)) || sentAt.After(now.Add(g.window)) {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// requests outside of window are rejected anyway,
+	// so there is no need to remember them
+	for k, t := range g.seen {
+		if t.Before(now.Add(-g.window)) {
+			delete(g.seen, k)
+		}
+	}
+
+	k := replayKey{
+		identity: string(identity),
+		id:       id,
+		location: location,
+	}
+
+	if _, ok := g.seen[k]; ok {
+		return false
+	}
+
+	g.seen[k] = sentAt
+
+	return true
+}
@@ -0,0 +1,62 @@
+package chat
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func TestReplayGuard(t *testing.T) {
+	guard := newReplayGuard(time.Minute)
+	identity1, _, _ := ed25519.GenerateKey(nil)
+	identity2, _, _ := ed25519.GenerateKey(nil)
+	now := time.Now()
+
+	if !guard.check(identity1, 1, 5, now, now) {
+		t.Fatalf("first request: ok = %v, want = %v", false, true)
+	}
+
+	if guard.check(identity1, 1, 5, now, now) {
+		t.Errorf("replayed request: ok = %v, want = %v", true, false)
+	}
+
+	if !guard.check(identity1, 2, 5, now, now) {
+		t.Errorf("another ID: ok = %v, want = %v", false, true)
+	}
+
+	if !guard.check(identity2, 1, 5, now, now) {
+		t.Errorf("another identity: ok = %v, want = %v", false, true)
+	}
+
+	if !guard.check(identity1, 1, 6, now, now) {
+		t.Errorf("another room: ok = %v, want = %v", false, true)
+	}
+
+	if guard.check(identity1, 3, 5, now.Add(-time.Minute*2), now) {
+		t.Errorf("old request: ok = %v, want = %v", true, false)
+	}
+
+	if guard.check(identity1, 4, 5, now.Add(time.Minute*2), now) {
+		t.Errorf("future request: ok = %v, want = %v", true, false)
+	}
+}
+
+func TestReplayGuardForget(t *testing.T) {
+	guard := newReplayGuard(time.Minute)
+	identity, _, _ := ed25519.GenerateKey(nil)
+	now := time.Now()
+	guard.check(identity, 1, 5, now, now)
+
+	// request is outside of window, so it is forgotten
+	// and can't be accepted again
+	later := now.Add(time.Minute * 2)
+	guard.check(identity, 2, 5, later, later)
+
+	if n := len(guard.seen); n != 1 {
+		t.Errorf("seen = %v, want = %v", n, 1)
+	}
+
+	if guard.check(identity, 1, 5, now, later) {
+		t.Errorf("ok = %v, want = %v", true, false)
+	}
+}
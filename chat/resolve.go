@@ -0,0 +1,94 @@
+package chat
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Amaimersion/terminal-chat/network"
+	"github.com/Amaimersion/terminal-chat/protocol"
+)
+
+const (
+	// How long to wait for resolving of user host name.
+	resolveTimeout = time.Second * 3
+
+	// How long resolved addresses of user host name are used
+	// before they will be resolved again. Failed resolving is
+	// retried after the same time.
+	resolveTTL = time.Minute
+)
+
+// resolvedURLs caches resolved addresses of user with host name,
+// so incoming requests are matched without DNS queries that can
+// block handling of other requests.
+//
+// It is shared between copies of userInfo. Methods are safe for nil
+// cache, such cache is always empty.
+type resolvedURLs struct {
+	mu         sync.Mutex
+	urls       []protocol.URL
+	resolvedAt time.Time
+	refreshing bool
+}
+
+// cached returns cached addresses of url. If they are stale, then
+// they will be refreshed in background using r, so result may be
+// outdated or empty. It never blocks on DNS.
+func (c *resolvedURLs) cached(url protocol.URL, r network.Resolver) []protocol.URL {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	urls := c.urls
+	stale := c.isStale()
+	c.mu.Unlock()
+
+	if stale {
+		go c.refresh(url, r)
+	}
+
+	return urls
+}
+
+// refresh resolves url using r if cached addresses are stale.
+// It blocks until resolving is done. Only one resolving is
+// made at once, other calls return immediately.
+func (c *resolvedURLs) refresh(url protocol.URL, r network.Resolver) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+
+	if !c.isStale() || c.refreshing {
+		c.mu.Unlock()
+		return
+	}
+
+	c.refreshing = true
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+
+	urls, err := network.Resolve(ctx, r, url)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// previous addresses are better than nothing
+	if err == nil {
+		c.urls = urls
+	}
+
+	c.resolvedAt = time.Now()
+	c.refreshing = false
+}
+
+// isStale reports whether addresses should be resolved again.
+// Lock should be held.
+func (c *resolvedURLs) isStale() bool {
+	return time.Since(c.resolvedAt) > resolveTTL
+}
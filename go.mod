@@ -2,4 +2,7 @@ module github.com/Amaimersion/terminal-chat
 
 go 1.17
 
-require golang.org/x/sys v0.0.0-20211103235746-7861aae1554b
+require (
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	golang.org/x/sys v0.0.0-20211103235746-7861aae1554b
+)
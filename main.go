@@ -25,7 +25,7 @@ func main() {
 }
 
 func getChatFlags() (chat.Flags, error) {
-	var in, out, address, port string
+	var in, out, address, port, config string
 
 	flag.StringVar(
 		&in,
@@ -51,14 +51,21 @@ func getChatFlags() (chat.Flags, error) {
 		"4444",
 		"What TCP port to use for local server.",
 	)
+	flag.StringVar(
+		&config,
+		"config",
+		"",
+		"Where to keep keys. Empty means default config directory.",
+	)
 
 	flag.Parse()
 
 	flags := chat.Flags{
-		In:      nil,
-		Out:     nil,
-		Address: address,
-		Port:    port,
+		In:        nil,
+		Out:       nil,
+		Address:   address,
+		Port:      port,
+		ConfigDir: config,
 	}
 
 	if in == "/dev/stdin" {
@@ -0,0 +1,40 @@
+package network
+
+import (
+	"sync"
+)
+
+const (
+	// Initial capacity of pooled buffers, enough
+	// for header along with short text
+	bufferSize = 4096
+
+	// Buffers that have grown above that are not
+	// pooled, so rare big messages don't hold memory
+	maxPooledBufferSize = 64 * 1024
+)
+
+var buffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, bufferSize)
+		return &b
+	},
+}
+
+// getBuffer returns empty buffer from pool.
+func getBuffer() *[]byte {
+	b := buffers.Get().(*[]byte)
+	*b = (*b)[:0]
+
+	return b
+}
+
+// putBuffer returns buffer to pool.
+// Buffer should not be used after that.
+func putBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBufferSize {
+		return
+	}
+
+	buffers.Put(b)
+}
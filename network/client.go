@@ -1,46 +1,729 @@
 package network
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/Amaimersion/terminal-chat/protocol"
 )
 
+// Client sends requests to remote peers.
+//
+// Client keeps one long-lived connection per remote peer
+// and reuses it for all requests to that peer. Broken
+// connections are detected and reestablished automatically.
+// Peers that don't respond to handshake are expected to read
+// single packet per connection, so every request to them is
+// sent using its own connection.
+//
+// Zero value is a valid client without any timeouts.
+// Client is safe for concurrent use.
+type Client struct {
+	// How long connection may stay unused before it will be closed.
+	// Zero means that connection will be kept open until remote
+	// peer closes it.
+	IdleTimeout time.Duration
+
+	// Interval between TCP keep-alive probes.
+	// Zero means default interval, negative value disables probes.
+	KeepAlive time.Duration
+
+	// Maximum amount of time to wait for a connection to be established.
+	// Zero means no timeout.
+	DialTimeout time.Duration
+
+	// TCP port on which local server listens for incoming requests.
+	// It is advertised to remote peers, so they are able to identify
+	// sender and send responses. Zero means nothing will be advertised.
+	ListenPort uint16
+
+	// Resolver is used to resolve host names of remote peers.
+	// Host names are resolved every time when new connection
+	// is opened. nil means net.DefaultResolver.
+	Resolver Resolver
+
+	// Optional protocol features that are supported by local peer.
+	// They are advertised to remote peers in every request.
+	Capabilities protocol.Capabilities
+
+	// Identity is used to sign every request, so remote
+	// peers can identify local peer by its public key
+	// instead of IP address. nil means requests are
+	// not signed.
+	Identity ed25519.PrivateKey
+
+	// Handshake enables asking of remote peer about its capabilities
+	// when new connection is opened. Remote peers that don't respond
+	// in time, like v1 peers, are considered as peers without any
+	// capabilities. Connection that carried handshake is closed in
+	// that case, and handshake is not made with such peers again.
+	// See PeerCapabilities for more.
+	Handshake bool
+
+	// How long to wait for response of remote peer at handshake.
+	// Zero means default timeout.
+	HandshakeTimeout time.Duration
+
+	// Configuration of TLS for remote peers with secure URL.
+	// Server name is taken from URL if it is not specified.
+	// nil means default configuration.
+	TLSConfig *tls.Config
+
+	// Maximum length of payload of single request. Payloads that don't fit
+	// into single packet are fragmented, and they can be sent only to
+	// peers with protocol.CapFragmentation, so Handshake should be
+	// enabled. The same applies to locations above
+	// protocol.MaxNarrowPortValue and protocol.CapWideLocations.
+	// Zero means protocol.DefaultMaxMessageLength.
+	MaxMessageLength int
+
+	mu    sync.Mutex
+	conns map[string]*clientConn
+
+	// addresses of peers that didn't respond to handshake
+	legacy map[string]bool
+
+	// tracks requests that are being sent
+	sending sync.WaitGroup
+
+	// Shutdown was called, new requests are rejected
+	// and new connections are not kept after that
+	closed bool
+}
+
+// ErrClientClosed is returned by Send after call of Shutdown.
+var ErrClientClosed = errors.New("client closed")
+
+// DefaultClient is the client used by Send.
+var DefaultClient = &Client{
+	IdleTimeout: time.Minute * 5,
+	KeepAlive:   time.Second * 15,
+	DialTimeout: time.Second * 10,
+}
+
+// Send sends request using DefaultClient.
+//
+// See Client.Send() documentation for more.
+func Send(req Request) error {
+	return DefaultClient.Send(req)
+}
+
 // Send sends request to the specified Remote from req.
 //
+// Existing connection to Remote will be used if possible.
+// If existing connection is broken, then request will be sent
+// once again using new connection.
+//
+// Payload that is too big for single packet will be fragmented.
+// All fragments are sent at once using same connection.
+//
+// Payload is compressed only if remote peer supports that.
+//
+// Connection is protected with TLS if Remote is secure.
+// ErrCertificateMismatch will be returned before sending
+// if certificate of remote peer doesn't match
+// CertificateFingerprint of request.
+//
 // ErrMalformedRequest will be returned before sending in case
-// if request is malformed. Appropriate error will be returned
-// in case of net error.
-func Send(req Request) error {
+// if request is malformed, contains invalid text or exceeds
+// MaxMessageLength. ErrUnsupportedByPeer will be returned before
+// sending in case if request requires fragmentation, wide
+// locations or encryption that are not supported by remote peer. Appropriate
+// error will be returned in case of net error.
+//
+// ErrClientClosed will be returned after call of Shutdown.
+func (c *Client) Send(req Request) error {
+	if err := c.trackSend(); err != nil {
+		return err
+	}
+
+	defer c.sending.Done()
+
 	if req.Remote.IsEmpty() {
 		return ErrMalformedRequest
 	}
 
+	maxLength := c.MaxMessageLength
+
+	if maxLength == 0 {
+		maxLength = protocol.DefaultMaxMessageLength
+	}
+
+	if len(req.Payload) > maxLength {
+		return ErrMalformedRequest
+	}
+
 	packet := protocol.Packet{
-		Payload:         req.Text,
+		Payload:         req.Payload,
+		ContentType:     req.ContentType,
+		Checksum:        req.Checksum,
+		Timestamp:       req.Timestamp,
+		MessageID:       req.MessageID,
 		SourcePort:      req.HandlerLocation,
 		DestinationPort: req.Remote.Location,
+		ListenPort:      c.ListenPort,
+		Capabilities:    c.Capabilities,
+	}
+
+	if req.Ack {
+		packet.Flags |= protocol.FlagAck
+	}
+
+	if req.Encrypted {
+		packet.Flags |= protocol.FlagEncrypted
 	}
-	data, err := protocol.Marshal(packet)
+
+	// features that should be supported by remote peer
+	var required protocol.Capabilities
+
+	if packet.HasWideLocations() {
+		required |= protocol.CapWideLocations
+	}
+
+	if len(packet.Payload) > protocol.MaxPayloadLength {
+		required |= protocol.CapFragmentation
+	}
+
+	if req.Encrypted {
+		required |= protocol.CapEncryption
+	}
+
+	// fragments can't be reassembled without ID
+	if required.Has(protocol.CapFragmentation) && packet.MessageID == 0 {
+		id, err := NewMessageID()
+
+		if err != nil {
+			return err
+		}
+
+		packet.MessageID = id
+	}
+
+	// whole message is signed, so it can be
+	// verified only after reassembly
+	if c.Identity != nil {
+		packet.Sign(c.Identity)
+	}
+
+	fragments, err := protocol.Split(packet)
 
 	if err != nil {
 		return ErrMalformedRequest
 	}
 
-	address := req.Remote.StringTCPIP()
-	conn, err := net.Dial("tcp", address)
+	address := connAddress(req.Remote)
+
+	for {
+		cc, fresh, err := c.getConn(address, req.Remote)
+
+		if err != nil {
+			return err
+		}
+
+		if !cc.capabilities.Has(required) {
+			return ErrUnsupportedByPeer
+		}
+
+		if cc.legacy {
+			if cc, err = c.dialConn(req.Remote); err != nil {
+				return err
+			}
+
+			defer cc.close()
+		} else if cc.temporary {
+			defer cc.close()
+		}
+
+		if req.CertificateFingerprint != nil && !cc.hasCertificate(req.CertificateFingerprint) {
+			return ErrCertificateMismatch
+		}
+
+		// compression is optional, so it is
+		// silently skipped for unsupported peers
+		compress := req.Compress && cc.capabilities.Has(protocol.CapCompression)
+		buf := getBuffer()
+		*buf, err = marshalFragments((*buf)[:0], fragments, compress)
+
+		if err != nil {
+			putBuffer(buf)
+			return ErrMalformedRequest
+		}
+
+		err = cc.write(*buf)
+		putBuffer(buf)
+
+		if err == nil {
+			return nil
+		}
+
+		c.removeConn(address, cc)
+
+		// There is no reason to retry if even new connection is broken.
+		if fresh {
+			return err
+		}
+	}
+}
+
+// marshalFragments appends all fragments to dst.
+func marshalFragments(dst []byte, fragments []protocol.Packet, compress bool) ([]byte, error) {
+	var err error
+
+	for _, f := range fragments {
+		f.Compress = compress
+
+		if dst, err = protocol.AppendMarshal(dst, f); err != nil {
+			return dst, err
+		}
+	}
+
+	return dst, nil
+}
+
+// NewMessageID returns random non-zero message ID
+// that can be used as Request.MessageID.
+func NewMessageID() (uint64, error) {
+	b := make([]byte, 8)
+
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return 0, err
+		}
+
+		if id := binary.BigEndian.Uint64(b); id != 0 {
+			return id, nil
+		}
+	}
+}
+
+// PeerCapabilities returns capabilities of remote peer.
+//
+// Existing connection to remote will be used if possible,
+// otherwise new connection will be opened. If Handshake
+// is disabled, then no capabilities will be returned.
+//
+// Caller should use optional protocol features only if
+// they are supported by remote peer.
+func (c *Client) PeerCapabilities(remote protocol.URL) (protocol.Capabilities, error) {
+	if remote.IsEmpty() {
+		return 0, ErrMalformedRequest
+	}
+
+	address := connAddress(remote)
+	cc, _, err := c.getConn(address, remote)
 
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	defer conn.Close()
+	if cc.temporary {
+		cc.close()
+	}
+
+	return cc.capabilities, nil
+}
+
+// PeerCertificate returns TLS certificate of remote peer.
+//
+// It is similar to PeerCapabilities. nil will be
+// returned if remote is not secure.
+func (c *Client) PeerCertificate(remote protocol.URL) (*x509.Certificate, error) {
+	if remote.IsEmpty() {
+		return nil, ErrMalformedRequest
+	}
 
-	_, err = conn.Write(data)
+	address := connAddress(remote)
+	cc, _, err := c.getConn(address, remote)
 
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if cc.legacy {
+		if cc, err = c.dialConn(remote); err != nil {
+			return nil, err
+		}
+
+		cc.close()
+	}
+
+	if cc.temporary {
+		cc.close()
+	}
+
+	return cc.certificate, nil
+}
+
+// connAddress returns key of connection to remote.
+//
+// Host names are kept as is, so connection will be
+// reused even if IP have been changed.
+func connAddress(remote protocol.URL) string {
+	address := remote.StringTCPIP()
+
+	if remote.Secure {
+		address = "tls/" + address
+	}
+
+	return address
+}
+
+// Close closes all opened connections.
+//
+// Client still can be used after Close, new
+// connections will be opened on demand.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	conns := c.conns
+	c.conns = nil
+	c.mu.Unlock()
+
+	for _, cc := range conns {
+		cc.close()
 	}
 
 	return nil
 }
+
+// Shutdown waits until all requests that are being sent
+// are done, and only after that closes all connections.
+// New requests are rejected after call of Shutdown.
+//
+// If ctx is done before all requests are done, then all
+// connections will be closed immediately and ctx error
+// will be returned.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		c.sending.Wait()
+		close(done)
+	}()
+
+	var err error
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	c.Close()
+
+	return err
+}
+
+// trackSend starts tracking of request that is being sent.
+// ErrClientClosed will be returned if Shutdown was called.
+func (c *Client) trackSend() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrClientClosed
+	}
+
+	c.sending.Add(1)
+
+	return nil
+}
+
+// getConn returns connection for address of remote.
+// If there is no such connection, then it will be opened,
+// in that case fresh will be true.
+//
+// Connection to peer that didn't respond to handshake is
+// not kept. Returned connection is legacy in that case,
+// and new connection should be opened for every request.
+//
+// Connections are not kept after call of Shutdown too.
+// Returned connection is temporary in that case, and it
+// should be closed after use.
+func (c *Client) getConn(address string, remote protocol.URL) (cc *clientConn, fresh bool, err error) {
+	c.mu.Lock()
+	cc, ok := c.conns[address]
+	legacy := c.legacy[address]
+	c.mu.Unlock()
+
+	if ok {
+		return cc, false, nil
+	}
+
+	if legacy {
+		return &clientConn{legacy: true}, true, nil
+	}
+
+	cc, err = c.dialConn(remote)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	if c.Handshake {
+		var answered bool
+		cc.capabilities, answered, err = c.handshake(cc.conn)
+
+		if err != nil {
+			cc.close()
+			return nil, false, err
+		}
+
+		// Older peers read single packet until connection is
+		// closed, so connection that carried hello is useless.
+		if !answered {
+			cc.close()
+
+			c.mu.Lock()
+
+			if c.legacy == nil {
+				c.legacy = make(map[string]bool)
+			}
+
+			c.legacy[address] = true
+			c.mu.Unlock()
+
+			return &clientConn{legacy: true}, true, nil
+		}
+	}
+
+	cc.idleTimeout = c.IdleTimeout
+
+	if cc.idleTimeout > 0 {
+		cc.idle = time.AfterFunc(cc.idleTimeout, func() {
+			c.removeConn(address, cc)
+		})
+	}
+
+	c.mu.Lock()
+
+	// Shutdown may close all connections at any moment,
+	// so connection can't be kept after that. It is closed
+	// by caller, idle timer is stopped at that moment too.
+	if c.closed {
+		c.mu.Unlock()
+		cc.temporary = true
+
+		return cc, true, nil
+	}
+
+	// someone else could open connection while we were dialing
+	if existing, ok := c.conns[address]; ok {
+		c.mu.Unlock()
+		cc.close()
+
+		return existing, false, nil
+	}
+
+	if c.conns == nil {
+		c.conns = make(map[string]*clientConn)
+	}
+
+	c.conns[address] = cc
+	c.mu.Unlock()
+
+	go func() {
+		cc.watch()
+		c.removeConn(address, cc)
+	}()
+
+	return cc, true, nil
+}
+
+// dialConn opens new connection to remote.
+func (c *Client) dialConn(remote protocol.URL) (*clientConn, error) {
+	conn, err := c.dial(remote)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &clientConn{
+		conn: conn,
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		cc.certificate = tlsConn.ConnectionState().PeerCertificates[0]
+	}
+
+	return cc, nil
+}
+
+// dial resolves remote and opens connection to first
+// available IP address. TLS handshake is made for
+// secure remote.
+func (c *Client) dial(remote protocol.URL) (net.Conn, error) {
+	ctx := context.Background()
+
+	if c.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.DialTimeout)
+		defer cancel()
+	}
+
+	urls, err := Resolve(ctx, c.Resolver, remote)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := net.Dialer{
+		KeepAlive: c.KeepAlive,
+	}
+
+	for _, url := range urls {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", url.StringTCPIP())
+
+		if err != nil {
+			continue
+		}
+
+		if !remote.Secure {
+			return conn, nil
+		}
+
+		tlsConn := tls.Client(conn, c.tlsConfig(remote))
+
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return tlsConn, nil
+	}
+
+	if err == nil {
+		err = &net.DNSError{
+			Err:        "no such host",
+			Name:       remote.Host,
+			IsNotFound: true,
+		}
+	}
+
+	return nil, err
+}
+
+const (
+	defaultHandshakeTimeout = time.Second * 2
+)
+
+// handshake asks remote peer about its capabilities.
+//
+// Absence of response is not an error, in that case answered
+// is false and remote peer is considered as peer without
+// any capabilities.
+func (c *Client) handshake(conn net.Conn) (caps protocol.Capabilities, answered bool, err error) {
+	hello := protocol.Packet{
+		Flags:        protocol.FlagHello,
+		ListenPort:   c.ListenPort,
+		Capabilities: c.Capabilities,
+	}
+	encoder := protocol.NewEncoder(conn)
+
+	if err := encoder.Encode(hello); err != nil {
+		return 0, false, err
+	}
+
+	timeout := c.HandshakeTimeout
+
+	if timeout == 0 {
+		timeout = defaultHandshakeTimeout
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	decoder := protocol.NewDecoder(conn)
+	response, err := decoder.Decode()
+
+	if err != nil || !response.Flags.Has(protocol.FlagHello) {
+		return 0, false, nil
+	}
+
+	return response.Capabilities, true, nil
+}
+
+// removeConn closes connection and forgets about it.
+func (c *Client) removeConn(address string, cc *clientConn) {
+	c.mu.Lock()
+
+	if c.conns[address] == cc {
+		delete(c.conns, address)
+	}
+
+	c.mu.Unlock()
+	cc.close()
+}
+
+type clientConn struct {
+	conn         net.Conn
+	capabilities protocol.Capabilities
+	certificate  *x509.Certificate
+	idleTimeout  time.Duration
+	idle         *time.Timer
+
+	// Peer didn't respond to handshake. Such connection
+	// is a placeholder without actual connection.
+	legacy bool
+
+	// Connection is not kept by client, because client
+	// is shut down. It should be closed after use.
+	temporary bool
+
+	// serializes writes of different requests
+	mu sync.Mutex
+}
+
+// hasCertificate reports whether remote peer
+// presented certificate with fingerprint.
+func (cc *clientConn) hasCertificate(fingerprint []byte) bool {
+	if cc.certificate == nil {
+		return false
+	}
+
+	return bytes.Equal(CertificateFingerprint(cc.certificate), fingerprint)
+}
+
+func (cc *clientConn) write(data []byte) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.idle != nil {
+		cc.idle.Reset(cc.idleTimeout)
+	}
+
+	_, err := cc.conn.Write(data)
+
+	return err
+}
+
+// watch blocks until connection is closed by remote peer
+// or becomes broken.
+//
+// Remote peer is not expected to send anything except
+// handshake response, so all arrived data is discarded.
+func (cc *clientConn) watch() {
+	io.Copy(io.Discard, cc.conn)
+}
+
+func (cc *clientConn) close() {
+	if cc.idle != nil {
+		cc.idle.Stop()
+	}
+
+	cc.conn.Close()
+}
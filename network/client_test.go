@@ -1,8 +1,15 @@
 package network_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"io"
+	"net"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/Amaimersion/terminal-chat/network"
 	"github.com/Amaimersion/terminal-chat/protocol"
@@ -10,7 +17,7 @@ import (
 
 func TestSendWithEmptyRemote(t *testing.T) {
 	req := network.Request{
-		Text:            "test",
+		Payload:         []byte("test"),
 		HandlerLocation: 1,
 	}
 	err := network.Send(req)
@@ -25,8 +32,8 @@ func TestSendBigPayload(t *testing.T) {
 		Address: []byte{127, 0, 0, 1},
 	}
 	req := network.Request{
-		Text:   strings.Repeat("a", protocol.MaxPayloadLength+1),
-		Remote: url,
+		Payload: []byte(strings.Repeat("a", protocol.DefaultMaxMessageLength+1)),
+		Remote:  url,
 	}
 	err := network.Send(req)
 
@@ -34,3 +41,629 @@ func TestSendBigPayload(t *testing.T) {
 		t.Errorf("err = %v, want = %v", err, network.ErrMalformedRequest)
 	}
 }
+
+func TestSendInvalidText(t *testing.T) {
+	url := protocol.URL{
+		Address: []byte{127, 0, 0, 1},
+	}
+	req := network.Request{
+		Payload: []byte{0xff, 0xfe},
+		Remote:  url,
+	}
+	err := network.Send(req)
+
+	if err != network.ErrMalformedRequest {
+		t.Errorf("err = %v, want = %v", err, network.ErrMalformedRequest)
+	}
+}
+
+// acceptConns listens on random local port and sends
+// every accepted connection to returned channel.
+func acceptConns(t *testing.T) (net.Listener, <-chan net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	conns := make(chan net.Conn, 10)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			conns <- conn
+		}
+	}()
+
+	return listener, conns
+}
+
+func listenerURL(listener net.Listener) protocol.URL {
+	addr := listener.Addr().(*net.TCPAddr)
+	url := protocol.URL{
+		Address: addr.IP,
+		Port:    uint16(addr.Port),
+	}
+
+	return url
+}
+
+// serveRequests starts s on random local port. All requests
+// that are handled by s are sent to returned channel. It returns
+// URL of s, caller should shut s down.
+func serveRequests(t *testing.T, s *network.Server) (protocol.URL, <-chan network.Request) {
+	requests := make(chan network.Request, 10)
+	s.HandleAll(func(req network.Request) {
+		requests <- req
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	go s.Serve(listener)
+
+	return listenerURL(listener), requests
+}
+
+func TestClientReusesConnection(t *testing.T) {
+	listener, conns := acceptConns(t)
+	defer listener.Close()
+
+	client := network.Client{}
+	defer client.Close()
+
+	req := network.Request{
+		Payload: []byte("test"),
+		Remote:  listenerURL(listener),
+	}
+
+	for i := 0; i != 3; i++ {
+		if err := client.Send(req); err != nil {
+			t.Fatalf("err = %v, want = nil", err)
+		}
+	}
+
+	conn := <-conns
+	decoder := protocol.NewDecoder(conn)
+
+	for i := 0; i != 3; i++ {
+		p, err := decoder.Decode()
+
+		if err != nil {
+			t.Fatalf("err = %v, want = nil", err)
+		}
+
+		if !bytes.Equal(p.Payload, req.Payload) {
+			t.Errorf("payload = %v, want = %v", p.Payload, req.Payload)
+		}
+	}
+
+	select {
+	case <-conns:
+		t.Error("new connection was opened, want reuse of existing one")
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestClientReconnects(t *testing.T) {
+	listener, conns := acceptConns(t)
+	defer listener.Close()
+
+	client := network.Client{}
+	defer client.Close()
+
+	req := network.Request{
+		Payload: []byte("test"),
+		Remote:  listenerURL(listener),
+	}
+
+	if err := client.Send(req); err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	conn := <-conns
+	conn.Close()
+
+	// give client some time to notice closed connection
+	time.Sleep(time.Millisecond * 100)
+
+	if err := client.Send(req); err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	select {
+	case <-conns:
+	case <-time.After(time.Second):
+		t.Error("timeout, want new connection")
+	}
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	listener, conns := acceptConns(t)
+	defer listener.Close()
+
+	client := network.Client{
+		IdleTimeout: time.Millisecond * 50,
+	}
+	defer client.Close()
+
+	req := network.Request{
+		Payload: []byte("test"),
+		Remote:  listenerURL(listener),
+	}
+
+	if err := client.Send(req); err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	conn := <-conns
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := io.ReadAll(conn)
+
+	if err != nil {
+		t.Errorf("err = %v, want connection to be closed by client", err)
+	}
+}
+
+func TestClientResolvesHostName(t *testing.T) {
+	listener, conns := acceptConns(t)
+	defer listener.Close()
+
+	url := listenerURL(listener)
+	client := network.Client{
+		Resolver: fakeResolver{
+			"bob.local": {{IP: url.Address}},
+		},
+	}
+	defer client.Close()
+
+	url.Address = nil
+	url.Host = "bob.local"
+	req := network.Request{
+		Payload: []byte("test"),
+		Remote:  url,
+	}
+
+	if err := client.Send(req); err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	select {
+	case <-conns:
+	case <-time.After(time.Second):
+		t.Error("timeout, want new connection")
+	}
+}
+
+func TestClientPeerCapabilities(t *testing.T) {
+	s := network.Server{
+		Capabilities: protocol.CapAcks | protocol.CapEncryption,
+	}
+	url, _ := serveRequests(t, &s)
+	defer s.Shutdown(context.Background())
+
+	client := network.Client{
+		Handshake: true,
+	}
+	defer client.Close()
+
+	caps, err := client.PeerCapabilities(url)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	want := s.Capabilities |
+		protocol.CapFragmentation |
+		protocol.CapChecksum |
+		protocol.CapWideLocations |
+		protocol.CapCompression |
+		protocol.CapSignatures
+
+	if caps != want {
+		t.Errorf("capabilities = %v, want = %v", caps, want)
+	}
+}
+
+func TestClientPeerCapabilitiesWithoutResponse(t *testing.T) {
+	listener, _ := acceptConns(t)
+	defer listener.Close()
+
+	client := network.Client{
+		Handshake:        true,
+		HandshakeTimeout: time.Millisecond * 50,
+	}
+	defer client.Close()
+
+	caps, err := client.PeerCapabilities(listenerURL(listener))
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if caps != 0 {
+		t.Errorf("capabilities = %v, want = 0", caps)
+	}
+}
+
+func TestClientSendsFragmentedText(t *testing.T) {
+	s := network.Server{}
+	url, requests := serveRequests(t, &s)
+	defer s.Shutdown(context.Background())
+
+	client := network.Client{
+		Handshake: true,
+	}
+	defer client.Close()
+
+	text := strings.Repeat("a", protocol.MaxPayloadLength*2+1)
+	req := network.Request{
+		Payload: []byte(text),
+		Remote:  url,
+	}
+
+	if err := client.Send(req); err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	select {
+	case req := <-requests:
+		if string(req.Payload) != text {
+			t.Errorf("payload length = %v, want = %v", len(req.Payload), len(text))
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout, want request")
+	}
+}
+
+func TestClientFragmentationNotSupported(t *testing.T) {
+	listener, _ := acceptConns(t)
+	defer listener.Close()
+
+	client := network.Client{
+		Handshake:        true,
+		HandshakeTimeout: time.Millisecond * 50,
+	}
+	defer client.Close()
+
+	req := network.Request{
+		Payload: []byte(strings.Repeat("a", protocol.MaxPayloadLength+1)),
+		Remote:  listenerURL(listener),
+	}
+	err := client.Send(req)
+
+	if err != network.ErrUnsupportedByPeer {
+		t.Errorf("err = %v, want = %v", err, network.ErrUnsupportedByPeer)
+	}
+}
+
+func TestClientWideLocations(t *testing.T) {
+	s := network.Server{}
+	url, requests := serveRequests(t, &s)
+	defer s.Shutdown(context.Background())
+
+	client := network.Client{
+		Handshake: true,
+	}
+	defer client.Close()
+
+	url.Location = 300
+	req := network.Request{
+		Payload:         []byte("test"),
+		HandlerLocation: 1000,
+		Remote:          url,
+	}
+
+	if err := client.Send(req); err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	select {
+	case req := <-requests:
+		if req.HandlerLocation != 300 || req.Remote.Location != 1000 {
+			t.Errorf("locations = %v/%v, want = 300/1000", req.HandlerLocation, req.Remote.Location)
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout, want request")
+	}
+}
+
+func TestClientWideLocationsNotSupported(t *testing.T) {
+	listener, _ := acceptConns(t)
+	defer listener.Close()
+
+	client := network.Client{
+		Handshake:        true,
+		HandshakeTimeout: time.Millisecond * 50,
+	}
+	defer client.Close()
+
+	url := listenerURL(listener)
+	url.Location = protocol.MaxNarrowPortValue + 1
+	req := network.Request{
+		Payload: []byte("test"),
+		Remote:  url,
+	}
+	err := client.Send(req)
+
+	if err != network.ErrUnsupportedByPeer {
+		t.Errorf("err = %v, want = %v", err, network.ErrUnsupportedByPeer)
+	}
+}
+
+func TestClientEncryptionNotSupported(t *testing.T) {
+	listener, _ := acceptConns(t)
+	defer listener.Close()
+
+	client := network.Client{
+		Handshake:        true,
+		HandshakeTimeout: time.Millisecond * 50,
+	}
+	defer client.Close()
+
+	req := network.Request{
+		Payload:   []byte{0xff, 0x00},
+		Encrypted: true,
+		Remote:    listenerURL(listener),
+	}
+	err := client.Send(req)
+
+	if err != network.ErrUnsupportedByPeer {
+		t.Errorf("err = %v, want = %v", err, network.ErrUnsupportedByPeer)
+	}
+}
+
+func TestClientSignsRequests(t *testing.T) {
+	s := network.Server{}
+	url, requests := serveRequests(t, &s)
+	defer s.Shutdown(context.Background())
+
+	public, private, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	client := network.Client{
+		Handshake: true,
+		Identity:  private,
+	}
+	defer client.Close()
+
+	req := network.Request{
+		Payload: []byte(strings.Repeat("a", protocol.MaxPayloadLength+1)),
+		Remote:  url,
+	}
+
+	if err := client.Send(req); err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	select {
+	case r := <-requests:
+		if !public.Equal(r.Identity) {
+			t.Errorf("identity = %v, want = %v", r.Identity, public)
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout, want request")
+	}
+}
+
+func TestClientCompression(t *testing.T) {
+	s := network.Server{}
+	url, requests := serveRequests(t, &s)
+	defer s.Shutdown(context.Background())
+
+	client := network.Client{
+		Handshake: true,
+	}
+	defer client.Close()
+
+	req := network.Request{
+		Payload:  []byte(strings.Repeat("a", 1000)),
+		Compress: true,
+		Remote:   url,
+	}
+
+	if err := client.Send(req); err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	select {
+	case r := <-requests:
+		if !r.Compress {
+			t.Errorf("compress = %v, want = %v", r.Compress, true)
+		}
+
+		if !bytes.Equal(r.Payload, req.Payload) {
+			t.Errorf("payload length = %v, want = %v", len(r.Payload), len(req.Payload))
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout, want request")
+	}
+}
+
+func TestClientCompressionNotSupported(t *testing.T) {
+	listener, conns := acceptConns(t)
+	defer listener.Close()
+
+	client := network.Client{}
+	defer client.Close()
+
+	req := network.Request{
+		Payload:  []byte(strings.Repeat("a", 1000)),
+		Compress: true,
+		Remote:   listenerURL(listener),
+	}
+
+	if err := client.Send(req); err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	conn := <-conns
+	p, err := protocol.NewDecoder(conn).Decode()
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if p.Compress {
+		t.Errorf("compress = %v, want = %v", p.Compress, false)
+	}
+}
+
+// startSlowSend starts sending of request to peer that doesn't
+// respond to handshake, so request stays in flight for timeout.
+// Returned channel will receive result of sending.
+func startSlowSend(t *testing.T, client *network.Client, timeout time.Duration) (net.Listener, <-chan error) {
+	listener, conns := acceptConns(t)
+	client.Handshake = true
+	client.HandshakeTimeout = timeout
+	errs := make(chan error, 1)
+
+	go func() {
+		req := network.Request{
+			Payload: []byte("text"),
+			Remote:  listenerURL(listener),
+		}
+		errs <- client.Send(req)
+	}()
+
+	select {
+	case <-conns:
+	case <-time.After(time.Second):
+		t.Fatal("timeout, want connection")
+	}
+
+	return listener, errs
+}
+
+func TestClientShutdownWaitsSend(t *testing.T) {
+	client := &network.Client{}
+	listener, errs := startSlowSend(t, client, time.Millisecond*200)
+	defer listener.Close()
+
+	if err := client.Shutdown(context.Background()); err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("send: err = %v, want = nil", err)
+		}
+	default:
+		t.Error("shutdown returned before send was done")
+	}
+}
+
+func TestClientShutdownTimeout(t *testing.T) {
+	client := &network.Client{}
+	listener, errs := startSlowSend(t, client, time.Second)
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	if err := client.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want = %v", err, context.DeadlineExceeded)
+	}
+
+	select {
+	case <-errs:
+		t.Error("send was done before shutdown timeout")
+	default:
+	}
+}
+
+func TestClientLegacyPeer(t *testing.T) {
+	listener, conns := acceptConns(t)
+	defer listener.Close()
+
+	// v1 peer reads single packet until connection is closed
+	received := make(chan []byte, 10)
+
+	go func() {
+		for conn := range conns {
+			go func(conn net.Conn) {
+				defer conn.Close()
+				data, _ := io.ReadAll(conn)
+				received <- data
+			}(conn)
+		}
+	}()
+
+	client := network.Client{
+		Handshake:        true,
+		HandshakeTimeout: time.Millisecond * 50,
+	}
+	defer client.Close()
+
+	texts := []string{"first", "second"}
+
+	for _, text := range texts {
+		req := network.Request{
+			Payload: []byte(text),
+			Remote:  listenerURL(listener),
+		}
+
+		if err := client.Send(req); err != nil {
+			t.Fatalf("err = %v, want = nil", err)
+		}
+	}
+
+	results := make([]string, 0, len(texts))
+
+	for len(results) < len(texts) {
+		select {
+		case data := <-received:
+			packet, err := protocol.Unmarshal(data)
+
+			if err != nil {
+				t.Fatalf("err = %v, want = nil", err)
+			}
+
+			// connection that carried hello is closed
+			if packet.Flags.Has(protocol.FlagHello) {
+				continue
+			}
+
+			results = append(results, string(packet.Payload))
+		case <-time.After(time.Second):
+			t.Fatalf("timeout, want packets %v", texts)
+		}
+	}
+
+	sort.Strings(results)
+
+	if strings.Join(results, " ") != strings.Join(texts, " ") {
+		t.Errorf("results = %v, want = %v", results, texts)
+	}
+}
+
+func TestClientSendAfterShutdown(t *testing.T) {
+	listener, _ := acceptConns(t)
+	defer listener.Close()
+
+	client := network.Client{}
+
+	if err := client.Shutdown(context.Background()); err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	req := network.Request{
+		Payload: []byte("text"),
+		Remote:  listenerURL(listener),
+	}
+
+	if err := client.Send(req); err != network.ErrClientClosed {
+		t.Errorf("err = %v, want = %v", err, network.ErrClientClosed)
+	}
+}
@@ -0,0 +1,139 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRateLimited is returned by RateLimiter when remote
+	// peer exceeds allowed rate.
+	ErrRateLimited = errors.New("rate limit exceeded")
+
+	// ErrBanned is returned by RateLimiter when remote peer
+	// is temporarily banned due to repeated rate limit violations.
+	ErrBanned = errors.New("remote peer is banned")
+)
+
+// RateLimiter limits rate of requests per remote IP address
+// using token bucket algorithm.
+//
+// Every remote IP have its own bucket that can hold up to Burst
+// tokens. Every request takes one token, and bucket is refilled
+// with Rate tokens per second. Requests without available tokens
+// are rejected.
+//
+// RateLimiter is safe for concurrent use.
+type RateLimiter struct {
+	// How many tokens are added to bucket every second.
+	Rate float64
+
+	// Maximum number of tokens in bucket, i.e. how many
+	// requests can be made at once.
+	Burst int
+
+	// How many requests in a row may be rejected before remote IP
+	// will be banned. Zero means remote IP will be never banned.
+	BanThreshold int
+
+	// How long ban lasts.
+	BanDuration time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens      float64
+	updatedAt   time.Time
+	rejected    int
+	bannedUntil time.Time
+}
+
+const (
+	// How often buckets of inactive remote IP's are deleted.
+	sweepInterval = time.Minute
+)
+
+// Allow takes token for request from remote ip.
+//
+// nil will be returned if request is allowed. ErrRateLimited
+// will be returned if there are no tokens. ErrBanned will be
+// returned if remote ip is banned.
+func (l *RateLimiter) Allow(ip net.IP) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(now)
+		l.lastSweep = now
+	}
+
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+
+	key := ip.String()
+	b, ok := l.buckets[key]
+
+	if !ok {
+		b = &bucket{
+			tokens:    float64(l.Burst),
+			updatedAt: now,
+		}
+		l.buckets[key] = b
+	}
+
+	if now.Before(b.bannedUntil) {
+		return ErrBanned
+	}
+
+	l.refill(b, now)
+
+	if b.tokens < 1 {
+		b.rejected++
+
+		if l.BanThreshold > 0 && b.rejected >= l.BanThreshold {
+			b.rejected = 0
+			b.bannedUntil = now.Add(l.BanDuration)
+		}
+
+		return ErrRateLimited
+	}
+
+	b.tokens--
+	b.rejected = 0
+
+	return nil
+}
+
+func (l *RateLimiter) refill(b *bucket, now time.Time) {
+	elapsed := now.Sub(b.updatedAt).Seconds()
+	b.tokens += elapsed * l.Rate
+	b.updatedAt = now
+
+	if max := float64(l.Burst); b.tokens > max {
+		b.tokens = max
+	}
+}
+
+// sweep deletes buckets that are full and not banned,
+// because they are equal to new ones.
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Before(b.bannedUntil) {
+			continue
+		}
+
+		l.refill(b, now)
+
+		if b.tokens >= float64(l.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package network_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Amaimersion/terminal-chat/network"
+)
+
+var limiterIP = net.IP{192, 168, 1, 235}
+
+func TestRateLimiterBurst(t *testing.T) {
+	l := network.RateLimiter{
+		Rate:  1,
+		Burst: 3,
+	}
+
+	for i := 0; i != 3; i++ {
+		if err := l.Allow(limiterIP); err != nil {
+			t.Fatalf("err = %v, want = nil", err)
+		}
+	}
+
+	if err := l.Allow(limiterIP); err != network.ErrRateLimited {
+		t.Errorf("err = %v, want = %v", err, network.ErrRateLimited)
+	}
+}
+
+func TestRateLimiterDifferentIP(t *testing.T) {
+	l := network.RateLimiter{
+		Rate:  1,
+		Burst: 1,
+	}
+
+	if err := l.Allow(limiterIP); err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if err := l.Allow(net.IP{127, 0, 0, 1}); err != nil {
+		t.Errorf("err = %v, want = nil", err)
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l := network.RateLimiter{
+		Rate:  100,
+		Burst: 1,
+	}
+
+	if err := l.Allow(limiterIP); err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	time.Sleep(time.Millisecond * 20)
+
+	if err := l.Allow(limiterIP); err != nil {
+		t.Errorf("err = %v, want = nil", err)
+	}
+}
+
+func TestRateLimiterBan(t *testing.T) {
+	l := network.RateLimiter{
+		Rate:         100,
+		Burst:        1,
+		BanThreshold: 2,
+		BanDuration:  time.Hour,
+	}
+	l.Allow(limiterIP)
+	l.Allow(limiterIP)
+	l.Allow(limiterIP)
+
+	time.Sleep(time.Millisecond * 20)
+
+	if err := l.Allow(limiterIP); err != network.ErrBanned {
+		t.Errorf("err = %v, want = %v", err, network.ErrBanned)
+	}
+}
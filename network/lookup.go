@@ -1,22 +1,68 @@
 package network
 
 import (
+	"context"
 	"errors"
 	"net"
+
+	"github.com/Amaimersion/terminal-chat/protocol"
 )
 
+// Resolver resolves host names into IP addresses.
+//
+// *net.Resolver implements this interface.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Resolve returns URLs with IP addresses that u refers to.
+//
+// If u have host name, then it will be resolved using r.
+// If r is nil, then net.DefaultResolver will be used.
+// If u have IP address, then it will be returned as is.
+func Resolve(ctx context.Context, r Resolver, u protocol.URL) ([]protocol.URL, error) {
+	if len(u.Host) == 0 {
+		return []protocol.URL{u}, nil
+	}
+
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	addrs, err := r.LookupIPAddr(ctx, u.Host)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]protocol.URL, 0, len(addrs))
+
+	for _, addr := range addrs {
+		resolved := u
+		resolved.Host = ""
+		resolved.Address = addr.IP
+		resolved.Zone = addr.Zone
+		result = append(result, resolved)
+	}
+
+	return result, nil
+}
+
 // LookupSystemNetwork performs lookup of all available host
 // IP addresses in the current system network. It returns a
-// list of unicast IPv4. These IP's can be used to dial this host
-// from another host in the same system network.
-func LookupSystemNetwork() ([]net.IP, error) {
+// list of unicast IPv4 and IPv6. These IP's can be used to dial
+// this host from another host in the same system network.
+//
+// Link-local IPv6 addresses have zone of their interface, because
+// they can't be used without it.
+func LookupSystemNetwork() ([]net.IPAddr, error) {
 	ifis, err := net.Interfaces()
 
 	if err != nil {
 		return nil, err
 	}
 
-	result := make([]net.IP, 0)
+	result := make([]net.IPAddr, 0)
 
 	for _, ifi := range ifis {
 		addrs, err := ifi.Addrs()
@@ -33,12 +79,6 @@ func LookupSystemNetwork() ([]net.IP, error) {
 				continue
 			}
 
-			ip = ip.To4()
-
-			if ip == nil {
-				continue
-			}
-
 			isUnicast :=
 				ip.IsGlobalUnicast() ||
 					ip.IsLinkLocalUnicast()
@@ -47,7 +87,17 @@ func LookupSystemNetwork() ([]net.IP, error) {
 				continue
 			}
 
-			result = append(result, ip)
+			ipAddr := net.IPAddr{
+				IP: ip,
+			}
+
+			if v4 := ip.To4(); v4 != nil {
+				ipAddr.IP = v4
+			} else if ip.IsLinkLocalUnicast() {
+				ipAddr.Zone = ifi.Name
+			}
+
+			result = append(result, ipAddr)
 		}
 	}
 
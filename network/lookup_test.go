@@ -0,0 +1,73 @@
+package network_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/Amaimersion/terminal-chat/network"
+	"github.com/Amaimersion/terminal-chat/protocol"
+)
+
+// fakeResolver resolves host names using predefined table.
+type fakeResolver map[string][]net.IPAddr
+
+func (r fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	addrs, ok := r[host]
+
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+
+	return addrs, nil
+}
+
+func TestResolveHostName(t *testing.T) {
+	r := fakeResolver{
+		"bob.local": {
+			{IP: net.IP{192, 168, 1, 2}},
+			{IP: net.ParseIP("fe80::2"), Zone: "eth0"},
+		},
+	}
+	u := protocol.URL{
+		Host:     "bob.local",
+		Port:     4444,
+		Location: 1,
+	}
+	urls, err := network.Resolve(context.Background(), r, u)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	want := []string{
+		"sttp://192.168.1.2:4444/1",
+		"sttp://[fe80::2%eth0]:4444/1",
+	}
+
+	if len(urls) != len(want) {
+		t.Fatalf("len(urls) = %v, want = %v", len(urls), len(want))
+	}
+
+	for i := range urls {
+		if s := urls[i].String(); s != want[i] {
+			t.Errorf("url = %v, want = %v", s, want[i])
+		}
+	}
+}
+
+func TestResolveIPAddress(t *testing.T) {
+	u := protocol.URL{
+		Address: net.IP{127, 0, 0, 1},
+	}
+	urls, err := network.Resolve(context.Background(), fakeResolver{}, u)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if len(urls) != 1 || !urls[0].IsEqual(u) {
+		t.Errorf("urls = %v, want = %v", urls, []protocol.URL{u})
+	}
+}
@@ -1,7 +1,9 @@
 package network
 
 import (
+	"crypto/ed25519"
 	"errors"
+	"time"
 
 	"github.com/Amaimersion/terminal-chat/protocol"
 )
@@ -14,12 +16,31 @@ var (
 	// So it indicates invalid logic at sender side,
 	// not that receiver is not able to handle this request
 	ErrMalformedRequest = errors.New("malformed request")
+
+	// ErrUnsupportedByPeer is returned when request requires
+	// optional protocol feature that is not supported by
+	// remote peer, like fragmentation of long payload or
+	// locations that don't fit into 4 bits.
+	//
+	// Note that this happens before sending.
+	ErrUnsupportedByPeer = errors.New("request is not supported by remote peer")
+
+	// ErrCertificateMismatch is returned when TLS certificate
+	// of remote peer doesn't match expected one. It may mean
+	// that somebody intercepts connection.
+	//
+	// Note that this happens before sending.
+	ErrCertificateMismatch = errors.New("certificate of remote peer doesn't match")
 )
 
 // Request is an incoming data from client
 type Request struct {
-	// UTF-8 text
-	Text string
+	// Arbitrary data, its format is described by ContentType
+	Payload []byte
+
+	// MIME type of Payload, like protocol.ContentTypeText.
+	// Empty means protocol.ContentTypeText
+	ContentType string
 
 	// At which location handler is expected to exists
 	// to handle request.
@@ -31,12 +52,99 @@ type Request struct {
 	// For outgoing requests it equal to the location of
 	// handler who should handle potential response
 	// (as separete request) according to sender opinion.
-	HandlerLocation uint8
+	HandlerLocation uint16
 
 	// URL of remote peer.
 	//
 	// For arrived requests it equal to the sender URL.
+	// Its TCP port is a port that was advertised by sender,
+	// or 0 if sender didn't advertise anything.
 	//
 	// For outgoing requests it equal to the receiver URL.
+	// Secure URL means that connection is protected with TLS.
 	Remote protocol.URL
+
+	// SHA-256 of TLS certificate that remote peer is expected
+	// to present, see CertificateFingerprint. It is used for
+	// pinning of self-signed certificates.
+	//
+	// For arrived requests it is nil.
+	//
+	// For outgoing requests nil means that any certificate
+	// accepted by Client.TLSConfig is allowed. It is
+	// ignored for not secure Remote.
+	CertificateFingerprint []byte
+
+	// Unique ID of message.
+	//
+	// For arrived requests it is zero if sender
+	// didn't specify it.
+	//
+	// For outgoing requests zero means that ID will
+	// be not sent, unless it is required for fragmentation.
+	// See NewMessageID.
+	MessageID uint64
+
+	// Ack marks request as acknowledgement of message
+	// with MessageID. It should be sent to the sender of
+	// message, that is, to Remote of arrived request, and
+	// only if sender supports protocol.CapAcks.
+	Ack bool
+
+	// When request was created by sender.
+	//
+	// For arrived requests it is zero if sender
+	// didn't specify it. Note that clock of sender
+	// may differ from local clock.
+	//
+	// For outgoing requests zero means that
+	// timestamp will be not sent.
+	Timestamp time.Time
+
+	// Whether checksum of payload is sent along with request.
+	//
+	// For arrived requests it equal to true if checksum
+	// was sent by sender and verified.
+	//
+	// For outgoing requests it enables sending of checksum.
+	Checksum bool
+
+	// Whether payload is compressed.
+	//
+	// For arrived requests it equal to true if
+	// payload was compressed by sender.
+	//
+	// For outgoing requests it enables compression
+	// if it is supported by remote peer.
+	Compress bool
+
+	// Whether payload is encrypted by application.
+	// Network layer doesn't encrypt or decrypt payload,
+	// it only marks request, see protocol.FlagEncrypted.
+	//
+	// For arrived requests it equal to true if
+	// payload was encrypted by sender.
+	//
+	// For outgoing requests it requires support of
+	// protocol.CapEncryption by remote peer.
+	Encrypted bool
+
+	// Public key that identifies remote peer.
+	//
+	// For arrived requests it equal to public key of sender
+	// whose signature was verified, or nil if request was
+	// not signed. Requests with invalid signature are dropped.
+	//
+	// For outgoing requests it is ignored,
+	// see Client.Identity instead.
+	Identity ed25519.PublicKey
+
+	// Optional protocol features that are supported by remote peer.
+	//
+	// For arrived requests it equal to capabilities that
+	// were advertised by sender.
+	//
+	// For outgoing requests it is ignored, see
+	// Client.PeerCapabilities instead.
+	Capabilities protocol.Capabilities
 }
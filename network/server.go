@@ -1,8 +1,14 @@
 package network
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/Amaimersion/terminal-chat/protocol"
 )
@@ -10,19 +16,114 @@ import (
 // Handler handles incoming request
 type Handler = func(req Request)
 
+// ErrServerClosed is returned by Serve and ListenAndServe
+// after call of Shutdown.
+var ErrServerClosed = errors.New("server closed")
+
+// Reasons why connection was dropped by server.
+// See Server.OnDrop for more. Note that protocol errors,
+// like protocol.ErrTooBigPacket, can be used as reasons too.
 var (
-	handlers           = make(map[uint8]Handler)
-	allHandler Handler = nil
+	// Remote peer didn't send anything for too long.
+	ErrIdleTimeout = errors.New("connection is idle for too long")
+
+	// Remote peer didn't complete packet in time.
+	ErrReadTimeout = errors.New("packet is read for too long")
+
+	// Maximum number of concurrent connections is reached.
+	ErrTooManyConns = errors.New("too many connections")
 )
 
+// Server serves STTP connections using registered handlers.
+//
+// Zero value is a valid server that will listen on
+// any available address. Server is safe for concurrent use.
+type Server struct {
+	// TCP network address to listen on by ListenAndServe.
+	// Empty means any address with random TCP port.
+	Address string
+
+	// How long to wait for next packet on opened connection.
+	// Zero means no timeout.
+	IdleTimeout time.Duration
+
+	// How long to wait for the rest of packet after its first
+	// byte has been arrived. Zero means no timeout.
+	ReadTimeout time.Duration
+
+	// Maximum length of single packet, including header.
+	// Connection that sends bigger packet will be dropped.
+	// Zero means protocol.MaxPacketLength.
+	MaxPacketLength int
+
+	// Maximum length of payload of fragmented message.
+	// Connection that sends bigger message will be dropped.
+	// Zero means protocol.DefaultMaxMessageLength.
+	MaxMessageLength int
+
+	// How long to wait for missing fragments of message.
+	// Incomplete messages are dropped silently after that.
+	// Zero means no timeout.
+	FragmentTimeout time.Duration
+
+	// Maximum number of concurrent connections.
+	// Zero means no limit.
+	MaxConns int
+
+	// Optional protocol features that are supported by server.
+	// They are sent in response to hello packets.
+	// Capabilities that are implemented by server itself,
+	// like protocol.CapFragmentation, are always sent.
+	Capabilities protocol.Capabilities
+
+	// Limiter limits rate of connections and requests per remote
+	// IP address. Both new connection and every arrived packet are
+	// counted as one request. Connections are rejected right after
+	// accepting, before anything is read from them.
+	// nil means no limits.
+	Limiter *RateLimiter
+
+	// OnDrop is called when connection is dropped by server
+	// due to some reason. Normal closing of connection by
+	// remote peer or at Shutdown is not considered as drop.
+	// It is also called with protocol.ErrTooManyMessages
+	// when only fragment is dropped, connection is kept
+	// in that case. nil means drops will be not reported.
+	OnDrop func(remote net.Addr, reason error)
+
+	// TLSConfig enables TLS. Connections that start with TLS
+	// handshake are served over TLS, other connections are still
+	// served as plain ones, so both secure and not secure URLs
+	// can be used to reach the same server. Config should contain
+	// at least one certificate. nil means TLS is not supported.
+	TLSConfig *tls.Config
+
+	mu         sync.RWMutex
+	handlers   map[uint16]Handler
+	allHandler Handler
+	listeners  []net.Listener
+	conns      map[net.Conn]struct{}
+	closed     bool
+
+	// tracks running connection handlers
+	wg sync.WaitGroup
+}
+
 // Handle binds specific handler to specific location.
 // Think of "location" like "port".
 // There can be only one handler on single location.
 // If you will try to bind more than one handler to
 // single location, then only last handler will be binded,
 // and previous handler will be deleted silently
-func Handle(location uint8, handler Handler) {
-	handlers[location] = handler
+func (s *Server) Handle(location uint16, handler Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.handlers == nil {
+		s.handlers = make(map[uint16]Handler)
+	}
+
+	s.handlers[location] = handler
 }
 
 // HandleAll is similar to Handle, but with difference that handler
@@ -34,84 +135,436 @@ func Handle(location uint8, handler Handler) {
 // If you will try to bind more than one any handler,
 // then only last handler will be binded, and previous handler
 // will be deleted silently.
-func HandleAll(handler Handler) {
-	allHandler = handler
+func (s *Server) HandleAll(handler Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.allHandler = handler
 }
 
 // ListenAndServe listens for TCP connections on
-// provided TCP network address and serves each
-// connection using registered handlers.
+// Address and serves them using Serve.
 //
 // If unable to start listen or serve, appropriate
 // error will be returned
-func ListenAndServe(address string) error {
-	listener, err := net.Listen("tcp", address)
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.Address)
 
 	if err != nil {
 		return err
 	}
 
+	return s.Serve(listener)
+}
+
+// Serve accepts incoming connections on listener
+// and serves each connection using registered handlers.
+//
+// Serve always closes listener before return.
+// After Shutdown ErrServerClosed will be returned,
+// otherwise appropriate error will be returned.
+func (s *Server) Serve(listener net.Listener) error {
 	defer listener.Close()
 
+	if !s.trackListener(listener) {
+		return ErrServerClosed
+	}
+
 	for {
 		conn, err := listener.Accept()
 
 		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+
+			return err
+		}
+
+		if err := s.allow(conn); err != nil {
+			s.drop(conn, err)
+			conn.Close()
+			continue
+		}
+
+		if err := s.trackConn(conn); err == ErrServerClosed {
+			conn.Close()
 			return err
+		} else if err != nil {
+			s.drop(conn, err)
+			conn.Close()
+			continue
 		}
 
-		go serve(conn)
+		go s.serve(conn)
 	}
 }
 
-const (
-	bufferSize = 1024 * 1
-)
+// Addr returns network address of first listener
+// that is currently served. It is useful in case if
+// TCP port 0 was used to pick random port.
+//
+// nil will be returned if nothing is served.
+func (s *Server) Addr() net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.listeners) == 0 {
+		return nil
+	}
+
+	return s.listeners[0].Addr()
+}
+
+// Shutdown gracefully stops server.
+//
+// At first it closes all listeners, so new connections will
+// be not accepted. Next it stops reading of new requests from
+// opened connections and waits until handlers of already read
+// requests are done. Server can't be used after that.
+//
+// If ctx is done before all handlers are done, then all
+// connections will be closed immediately and ctx error
+// will be returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+
+	for _, l := range s.listeners {
+		l.Close()
+	}
+
+	s.listeners = nil
+
+	// interrupt pending reads, handlers will be not interrupted
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+
+		for conn := range s.conns {
+			conn.Close()
+		}
+
+		s.mu.Unlock()
+
+		return ctx.Err()
+	}
+}
+
+// trackListener remembers listener in order to close it
+// at Shutdown. false will be returned if server is closed.
+func (s *Server) trackListener(listener net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.listeners = append(s.listeners, listener)
+
+	return true
+}
+
+// trackConn remembers connection in order to interrupt it
+// at Shutdown. ErrServerClosed will be returned if server is
+// closed, ErrTooManyConns will be returned if MaxConns is reached.
+func (s *Server) trackConn(conn net.Conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrServerClosed
+	}
+
+	if s.MaxConns > 0 && len(s.conns) >= s.MaxConns {
+		return ErrTooManyConns
+	}
+
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+
+	return nil
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+	s.wg.Done()
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.closed
+}
+
+// setReadDeadline sets read deadline of connection.
+// Zero timeout means no deadline.
+//
+// It will not override deadline that was set at Shutdown,
+// false will be returned in that case.
+func (s *Server) setReadDeadline(conn net.Conn, timeout time.Duration) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-func serve(conn net.Conn) {
+	if s.closed {
+		return false
+	}
+
+	t := time.Time{}
+
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+
+	conn.SetReadDeadline(t)
+
+	return true
+}
+
+// allow checks whether request from connection is allowed by Limiter.
+func (s *Server) allow(conn net.Conn) error {
+	if s.Limiter == nil {
+		return nil
+	}
+
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+
+	if !ok {
+		return nil
+	}
+
+	return s.Limiter.Allow(addr.IP)
+}
+
+// drop reports about dropped connection.
+func (s *Server) drop(conn net.Conn, reason error) {
+	if s.OnDrop != nil {
+		s.OnDrop(conn.RemoteAddr(), reason)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer s.untrackConn(conn)
 	defer conn.Close()
 
-	buffer := make([]byte, bufferSize)
-	data := make([]byte, 0)
+	reader := &packetReader{
+		server: s,
+		conn:   conn,
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if s.TLSConfig != nil {
+		if !s.setReadDeadline(conn, s.IdleTimeout) {
+			return
+		}
+
+		secured, err := s.secure(reader)
+
+		if err != nil {
+			if reason := s.dropReason(reader, err); reason != nil {
+				s.drop(conn, reason)
+			}
+
+			return
+		}
+
+		conn = secured
+		reader.conn = secured
+	}
+
+	decoder := protocol.NewDecoder(reader)
+	decoder.MaxLength = s.MaxPacketLength
+	decoder.Buffer(*buf)
+	reassembler := &protocol.Reassembler{
+		MaxLength: s.MaxMessageLength,
+		Timeout:   s.FragmentTimeout,
+	}
 
 	for {
-		n, err := conn.Read(buffer)
+		reader.started = false
+
+		if !s.setReadDeadline(conn, s.IdleTimeout) {
+			return
+		}
+
+		packet, err := decoder.Decode()
+
+		if err != nil {
+			if reason := s.dropReason(reader, err); reason != nil {
+				s.drop(conn, reason)
+			}
+
+			return
+		}
+
+		if err := s.allow(conn); err != nil {
+			s.drop(conn, err)
+			return
+		}
+
+		if packet.Flags.Has(protocol.FlagHello) {
+			if err := s.hello(conn); err != nil {
+				return
+			}
+
+			continue
+		}
+
+		packet, ok, err := reassembler.Add(packet)
+
+		if err == protocol.ErrTooManyMessages {
+			// only fragment is dropped, so other
+			// messages are still reassembled
+			s.drop(conn, err)
+			continue
+		}
 
-		if err != nil && err != io.EOF {
+		if err != nil {
+			s.drop(conn, err)
 			return
 		}
 
-		if n == 0 {
-			break
+		if !ok {
+			continue
 		}
 
-		data = append(data, buffer[:n]...)
+		if !packet.Signature.IsEmpty() && !packet.Verify() {
+			s.drop(conn, protocol.ErrInvalidSignature)
+			return
+		}
+
+		s.handle(conn, packet)
+	}
+}
+
+// Capabilities that are implemented by server itself.
+const builtinCapabilities = protocol.CapFragmentation |
+	protocol.CapChecksum |
+	protocol.CapWideLocations |
+	protocol.CapCompression |
+	protocol.CapSignatures
+
+// hello responds to hello packet with capabilities of server.
+func (s *Server) hello(conn net.Conn) error {
+	packet := protocol.Packet{
+		Flags:        protocol.FlagHello,
+		Capabilities: s.Capabilities | builtinCapabilities,
 	}
+	encoder := protocol.NewEncoder(conn)
+	err := encoder.Encode(packet)
 
-	packet, err := protocol.Unmarshal(data)
+	return err
+}
 
-	if err != nil {
-		return
+// dropReason converts error that occurred during reading of
+// packet into reason of drop. nil will be returned if connection
+// was closed normally.
+func (s *Server) dropReason(reader *packetReader, err error) error {
+	if err == io.EOF || s.isClosed() {
+		return nil
 	}
 
-	remoteTCPIP := conn.RemoteAddr().String()
-	remoteURL := protocol.URL{}
-	remoteURL.FromString(remoteTCPIP)
-	remoteURL.Location = packet.SourcePort
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		if reader.started {
+			return ErrReadTimeout
+		}
+
+		return ErrIdleTimeout
+	}
+
+	return err
+}
+
+// packetReader reads packets from connection and switches
+// connection deadline from idle timeout to read timeout
+// when first byte of packet arrives.
+type packetReader struct {
+	server  *Server
+	conn    net.Conn
+	started bool
+}
+
+func (r *packetReader) Read(p []byte) (int, error) {
+	n, err := r.conn.Read(p)
+
+	if n > 0 && !r.started {
+		r.started = true
+		r.server.setReadDeadline(r.conn, r.server.ReadTimeout)
+	}
+
+	return n, err
+}
+
+func (s *Server) handle(conn net.Conn, packet protocol.Packet) {
+	// TCP port of connection is a random port of sender
+	// that can't be used for responses, so only advertised
+	// port is used.
+	remoteURL := protocol.URL{
+		Port:     packet.ListenPort,
+		Location: packet.SourcePort,
+	}
+
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		remoteURL.Address = addr.IP
+		remoteURL.Zone = addr.Zone
+	}
+
+	_, remoteURL.Secure = conn.(*tls.Conn)
 
 	request := Request{
-		Text:            packet.Payload,
+		Payload:         packet.Payload,
+		ContentType:     packet.ContentType,
+		Checksum:        packet.Checksum,
+		Compress:        packet.Compress,
+		Timestamp:       packet.Timestamp,
+		MessageID:       packet.MessageID,
+		Ack:             packet.Flags.Has(protocol.FlagAck),
+		Encrypted:       packet.Flags.Has(protocol.FlagEncrypted),
 		HandlerLocation: packet.DestinationPort,
 		Remote:          remoteURL,
+		Capabilities:    packet.Capabilities,
 	}
-	handler, callHandler := handlers[packet.DestinationPort]
-	callAllHandler := allHandler != nil
+
+	if !packet.Signature.IsEmpty() {
+		key := packet.Signature.PublicKey
+		request.Identity = ed25519.PublicKey(key[:])
+	}
+
+	s.mu.RLock()
+	handler, callHandler := s.handlers[packet.DestinationPort]
+	allHandler := s.allHandler
+	s.mu.RUnlock()
 
 	if callHandler {
 		handler(request)
 	}
 
-	if callAllHandler {
+	if allHandler != nil {
 		allHandler(request)
 	}
 }
@@ -1,15 +1,23 @@
 package network
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"net"
 	"testing"
+	"time"
+
+	"github.com/Amaimersion/terminal-chat/protocol"
 )
 
 var handler Handler = func(_ Request) {}
 
 func TestHandlerRegistering(t *testing.T) {
-	Handle(0, handler)
+	s := Server{}
+	s.Handle(0, handler)
 
-	_, ok := handlers[0]
+	_, ok := s.handlers[0]
 
 	if !ok {
 		t.Error("request handler was not registered")
@@ -17,11 +25,531 @@ func TestHandlerRegistering(t *testing.T) {
 }
 
 func TestHandlerAllRegistering(t *testing.T) {
-	HandleAll(handler)
+	s := Server{}
+	s.HandleAll(handler)
 
-	exists := allHandler != nil
+	exists := s.allHandler != nil
 
 	if !exists {
 		t.Error("all requests handler was not registered")
 	}
 }
+
+// startServer starts serving s on random local port.
+// Returned channel will receive result of serving.
+func startServer(t *testing.T, s *Server) <-chan error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	errs := make(chan error, 1)
+
+	go func() {
+		errs <- s.Serve(listener)
+	}()
+
+	for s.Addr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	return errs
+}
+
+func TestServerServe(t *testing.T) {
+	requests := make(chan Request, 4)
+	s := Server{}
+	s.Handle(3, func(req Request) {
+		requests <- req
+	})
+	startServer(t, &s)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	defer conn.Close()
+
+	encoder := protocol.NewEncoder(conn)
+	packets := []protocol.Packet{
+		{Payload: []byte("first"), DestinationPort: 3, SourcePort: 1, Checksum: true, Timestamp: time.Unix(1600000000, 0)},
+		{Payload: []byte("second"), DestinationPort: 3, SourcePort: 2, ListenPort: 4444, ContentType: protocol.ContentTypeJSON},
+		{DestinationPort: 3, SourcePort: 2, MessageID: 5, Flags: protocol.FlagAck},
+		{Payload: []byte{0xff, 0x00}, DestinationPort: 3, SourcePort: 1, Flags: protocol.FlagEncrypted},
+	}
+
+	for _, p := range packets {
+		if err := encoder.Encode(p); err != nil {
+			t.Fatalf("err = %v, want = nil", err)
+		}
+	}
+
+	// packets should be handled before connection is closed
+	for _, p := range packets {
+		select {
+		case req := <-requests:
+			if !bytes.Equal(req.Payload, p.Payload) {
+				t.Errorf("payload = %v, want = %v", req.Payload, p.Payload)
+			}
+
+			if req.ContentType != p.ContentType {
+				t.Errorf("content type = %v, want = %v", req.ContentType, p.ContentType)
+			}
+
+			if req.Checksum != p.Checksum {
+				t.Errorf("checksum = %v, want = %v", req.Checksum, p.Checksum)
+			}
+
+			if !req.Timestamp.Equal(p.Timestamp) {
+				t.Errorf("timestamp = %v, want = %v", req.Timestamp, p.Timestamp)
+			}
+
+			if req.MessageID != p.MessageID {
+				t.Errorf("message ID = %v, want = %v", req.MessageID, p.MessageID)
+			}
+
+			if req.Ack != p.Flags.Has(protocol.FlagAck) {
+				t.Errorf("ack = %v, want = %v", req.Ack, p.Flags.Has(protocol.FlagAck))
+			}
+
+			if req.Encrypted != p.Flags.Has(protocol.FlagEncrypted) {
+				t.Errorf("encrypted = %v, want = %v", req.Encrypted, p.Flags.Has(protocol.FlagEncrypted))
+			}
+
+			if req.Remote.Location != p.SourcePort {
+				t.Errorf("remote location = %v, want = %v", req.Remote.Location, p.SourcePort)
+			}
+
+			if req.Remote.Port != p.ListenPort {
+				t.Errorf("remote port = %v, want = %v", req.Remote.Port, p.ListenPort)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	s := Server{}
+	errs := startServer(t, &s)
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	select {
+	case err := <-errs:
+		if err != ErrServerClosed {
+			t.Errorf("err = %v, want = %v", err, ErrServerClosed)
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout")
+	}
+
+	if err := s.ListenAndServe(); err != ErrServerClosed {
+		t.Errorf("err = %v, want = %v", err, ErrServerClosed)
+	}
+}
+
+func TestServersAreIndependent(t *testing.T) {
+	s1 := Server{}
+	s2 := Server{}
+	s1.HandleAll(handler)
+
+	if s2.allHandler != nil {
+		t.Error("handler of one server was registered in another server")
+	}
+}
+
+func TestServerShutdownWaitsHandlers(t *testing.T) {
+	started := make(chan bool)
+	finished := make(chan bool, 1)
+	s := Server{}
+	s.HandleAll(func(_ Request) {
+		started <- true
+		time.Sleep(time.Millisecond * 100)
+		finished <- true
+	})
+	startServer(t, &s)
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	defer conn.Close()
+
+	protocol.NewEncoder(conn).Encode(protocol.Packet{Payload: []byte("test")})
+	<-started
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	select {
+	case <-finished:
+	default:
+		t.Error("shutdown is done before handler")
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	release := make(chan bool)
+	started := make(chan bool)
+	s := Server{}
+	s.HandleAll(func(_ Request) {
+		started <- true
+		<-release
+	})
+	startServer(t, &s)
+	defer close(release)
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	defer conn.Close()
+
+	protocol.NewEncoder(conn).Encode(protocol.Packet{Payload: []byte("test")})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want = %v", err, context.DeadlineExceeded)
+	}
+}
+
+// expectDrop starts s and returns channel that
+// will receive reasons of dropped connections.
+func expectDrop(t *testing.T, s *Server) <-chan error {
+	reasons := make(chan error, 10)
+	s.OnDrop = func(_ net.Addr, reason error) {
+		reasons <- reason
+	}
+	startServer(t, s)
+
+	return reasons
+}
+
+func waitDrop(t *testing.T, reasons <-chan error, want error) {
+	select {
+	case reason := <-reasons:
+		if reason != want {
+			t.Errorf("reason = %v, want = %v", reason, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("timeout, want drop with reason = %v", want)
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	s := Server{
+		IdleTimeout: time.Millisecond * 50,
+	}
+	reasons := expectDrop(t, &s)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	defer conn.Close()
+
+	waitDrop(t, reasons, ErrIdleTimeout)
+}
+
+func TestServerReadTimeout(t *testing.T) {
+	s := Server{
+		ReadTimeout: time.Millisecond * 50,
+	}
+	reasons := expectDrop(t, &s)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	defer conn.Close()
+
+	// incomplete header
+	conn.Write([]byte{0, 5})
+
+	waitDrop(t, reasons, ErrReadTimeout)
+}
+
+func TestServerTooBigPacket(t *testing.T) {
+	s := Server{
+		MaxPacketLength: 8,
+	}
+	reasons := expectDrop(t, &s)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	defer conn.Close()
+
+	protocol.NewEncoder(conn).Encode(protocol.Packet{Payload: []byte("too long")})
+
+	waitDrop(t, reasons, protocol.ErrTooBigPacket)
+}
+
+func TestServerChecksumMismatch(t *testing.T) {
+	s := Server{}
+	reasons := expectDrop(t, &s)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	defer conn.Close()
+
+	data, _ := protocol.Marshal(protocol.Packet{
+		Payload:  []byte("test"),
+		Checksum: true,
+	})
+	data[len(data)-1] ^= 1
+	conn.Write(data)
+
+	waitDrop(t, reasons, protocol.ErrChecksumMismatch)
+}
+
+func TestServerInvalidSignature(t *testing.T) {
+	s := Server{}
+	reasons := expectDrop(t, &s)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	defer conn.Close()
+
+	packet := protocol.Packet{
+		Payload: []byte("test"),
+	}
+	packet.Sign(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	packet.Payload = []byte("tost")
+	protocol.NewEncoder(conn).Encode(packet)
+
+	waitDrop(t, reasons, protocol.ErrInvalidSignature)
+}
+
+func TestServerTooBigMessage(t *testing.T) {
+	s := Server{
+		MaxMessageLength: protocol.MaxPayloadLength,
+	}
+	reasons := expectDrop(t, &s)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	defer conn.Close()
+
+	p := protocol.Packet{
+		Payload:   []byte("first fragment"),
+		MessageID: 1,
+		Fragment: protocol.Fragment{
+			Index: 0,
+			Count: 2,
+		},
+	}
+	protocol.NewEncoder(conn).Encode(p)
+
+	waitDrop(t, reasons, protocol.ErrTooBigMessage)
+}
+
+func TestServerTooManyMessages(t *testing.T) {
+	requests := make(chan Request, 1)
+	s := Server{}
+	s.HandleAll(func(req Request) {
+		requests <- req
+	})
+	reasons := expectDrop(t, &s)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	defer conn.Close()
+
+	encoder := protocol.NewEncoder(conn)
+
+	for id := 1; id <= protocol.DefaultMaxMessages+1; id++ {
+		p := protocol.Packet{
+			Payload:   []byte("first fragment"),
+			MessageID: uint64(id),
+			Fragment: protocol.Fragment{
+				Index: 0,
+				Count: 2,
+			},
+		}
+		encoder.Encode(p)
+	}
+
+	waitDrop(t, reasons, protocol.ErrTooManyMessages)
+
+	// connection is still served
+	encoder.Encode(protocol.Packet{Payload: []byte("text")})
+
+	select {
+	case req := <-requests:
+		if string(req.Payload) != "text" {
+			t.Errorf("payload = %q, want = text", req.Payload)
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout, want request")
+	}
+}
+
+func TestServerMaxConns(t *testing.T) {
+	s := Server{
+		MaxConns: 1,
+	}
+	reasons := expectDrop(t, &s)
+	defer s.Shutdown(context.Background())
+
+	for i := 0; i != 2; i++ {
+		conn, err := net.Dial("tcp", s.Addr().String())
+
+		if err != nil {
+			t.Fatalf("err = %v, want = nil", err)
+		}
+
+		defer conn.Close()
+	}
+
+	waitDrop(t, reasons, ErrTooManyConns)
+}
+
+func TestServerRateLimit(t *testing.T) {
+	s := Server{
+		Limiter: &RateLimiter{
+			Rate:  0,
+			Burst: 1,
+		},
+	}
+	reasons := expectDrop(t, &s)
+	defer s.Shutdown(context.Background())
+
+	for i := 0; i != 2; i++ {
+		conn, err := net.Dial("tcp", s.Addr().String())
+
+		if err != nil {
+			t.Fatalf("err = %v, want = nil", err)
+		}
+
+		defer conn.Close()
+	}
+
+	waitDrop(t, reasons, ErrRateLimited)
+}
+
+func TestServerHello(t *testing.T) {
+	handled := make(chan bool, 1)
+	s := Server{
+		Capabilities: protocol.CapAcks,
+	}
+	s.HandleAll(func(_ Request) {
+		handled <- true
+	})
+	startServer(t, &s)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	defer conn.Close()
+
+	protocol.NewEncoder(conn).Encode(protocol.Packet{Flags: protocol.FlagHello})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	p, err := protocol.NewDecoder(conn).Decode()
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	if !p.Flags.Has(protocol.FlagHello) {
+		t.Errorf("flags = %v, want = %v", p.Flags, protocol.FlagHello)
+	}
+
+	want := s.Capabilities | builtinCapabilities
+
+	if p.Capabilities != want {
+		t.Errorf("capabilities = %v, want = %v", p.Capabilities, want)
+	}
+
+	select {
+	case <-handled:
+		t.Error("hello packet was handled as regular packet")
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func BenchmarkServerServe(b *testing.B) {
+	b.ReportAllocs()
+
+	handled := make(chan struct{}, 1)
+	s := Server{}
+	s.HandleAll(func(_ Request) {
+		handled <- struct{}{}
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		b.Fatalf("err = %v, want = nil", err)
+	}
+
+	go s.Serve(listener)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+
+	if err != nil {
+		b.Fatalf("err = %v, want = nil", err)
+	}
+
+	defer conn.Close()
+
+	data, _ := protocol.Marshal(protocol.Packet{
+		Payload: []byte("benchmark"),
+	})
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		conn.Write(data)
+		<-handled
+	}
+}
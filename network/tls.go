@@ -0,0 +1,97 @@
+package network
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+
+	"github.com/Amaimersion/terminal-chat/protocol"
+)
+
+// CertificateFingerprint returns SHA-256 of certificate.
+// It can be used as Request.CertificateFingerprint.
+func CertificateFingerprint(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.Raw)
+	return sum[:]
+}
+
+// Length of connection prefix that is enough to
+// distinguish TLS handshake from STTP packet.
+const tlsPrefixLength = 3
+
+// isTLSHandshake reports whether prefix of connection data
+// is a beginning of TLS handshake.
+//
+// TLS connection starts with handshake record: 0x16 and
+// version 3.x, where minor version is less than 4. Third byte
+// of STTP packet is a header length that is never less than 4,
+// so they can't be confused.
+func isTLSHandshake(prefix []byte) bool {
+	is :=
+		prefix[0] == 0x16 &&
+			prefix[1] == 0x03 &&
+			prefix[2] < 4
+
+	return is
+}
+
+// prefixedConn is a connection whose first bytes
+// were already read. They are returned by Read first.
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	if len(c.prefix) == 0 {
+		return c.Conn.Read(p)
+	}
+
+	n := copy(p, c.prefix)
+	c.prefix = c.prefix[n:]
+
+	return n, nil
+}
+
+// secure wraps connection that was read by r into TLS
+// if remote peer starts TLS handshake. Otherwise plain
+// connection is returned as is.
+func (s *Server) secure(r *packetReader) (net.Conn, error) {
+	prefix := make([]byte, tlsPrefixLength)
+
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+
+	conn := &prefixedConn{
+		Conn:   r.conn,
+		prefix: prefix,
+	}
+
+	if !isTLSHandshake(prefix) {
+		return conn, nil
+	}
+
+	return tls.Server(conn, s.TLSConfig), nil
+}
+
+// tlsConfig returns TLS configuration for connection to remote.
+func (c *Client) tlsConfig(remote protocol.URL) *tls.Config {
+	config := &tls.Config{}
+
+	if c.TLSConfig != nil {
+		config = c.TLSConfig.Clone()
+	}
+
+	if len(config.ServerName) == 0 {
+		config.ServerName = remote.Host
+
+		if len(remote.Host) == 0 {
+			config.ServerName = remote.Address.String()
+		}
+	}
+
+	return config
+}
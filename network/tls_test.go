@@ -0,0 +1,172 @@
+package network
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Amaimersion/terminal-chat/protocol"
+)
+
+// newCertificate returns self-signed certificate for tests.
+func newCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	cert := tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+
+	return cert
+}
+
+// startTLSServer starts s with new certificate and
+// returns secure URL of it.
+func startTLSServer(t *testing.T, s *Server) protocol.URL {
+	s.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{newCertificate(t)},
+	}
+	startServer(t, s)
+
+	addr := s.Addr().(*net.TCPAddr)
+	url := protocol.URL{
+		Address: addr.IP,
+		Port:    uint16(addr.Port),
+		Secure:  true,
+	}
+
+	return url
+}
+
+func TestIsTLSHandshake(t *testing.T) {
+	cases := []struct {
+		prefix []byte
+		want   bool
+	}{
+		{[]byte{0x16, 0x03, 0x01}, true},
+		{[]byte{0x16, 0x03, 0x03}, true},
+		{[]byte{0x16, 0x03, 0x04}, false},
+		{[]byte{0x00, 0x16, 0x0a}, false},
+		{[]byte{0x16, 0x00, 0x0a}, false},
+	}
+
+	for _, c := range cases {
+		if got := isTLSHandshake(c.prefix); got != c.want {
+			t.Errorf("%v: got = %v, want = %v", c.prefix, got, c.want)
+		}
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	requests := make(chan Request, 2)
+	s := Server{}
+	s.HandleAll(func(req Request) {
+		requests <- req
+	})
+	url := startTLSServer(t, &s)
+	defer s.Shutdown(context.Background())
+
+	client := Client{
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+	defer client.Close()
+
+	cert, err := client.PeerCertificate(url)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = nil", err)
+	}
+
+	plain := url
+	plain.Secure = false
+	reqs := []Request{
+		{Payload: []byte("secure"), Remote: url, CertificateFingerprint: CertificateFingerprint(cert)},
+		{Payload: []byte("plain"), Remote: plain},
+	}
+
+	for _, req := range reqs {
+		if err := client.Send(req); err != nil {
+			t.Fatalf("err = %v, want = nil", err)
+		}
+
+		select {
+		case r := <-requests:
+			if string(r.Payload) != string(req.Payload) {
+				t.Errorf("payload = %q, want = %q", r.Payload, req.Payload)
+			}
+
+			if r.Remote.Secure != req.Remote.Secure {
+				t.Errorf("secure = %v, want = %v", r.Remote.Secure, req.Remote.Secure)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout, want request")
+		}
+	}
+}
+
+func TestClientCertificateMismatch(t *testing.T) {
+	s := Server{}
+	url := startTLSServer(t, &s)
+	defer s.Shutdown(context.Background())
+
+	client := Client{
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+	defer client.Close()
+
+	req := Request{
+		Payload:                []byte("text"),
+		Remote:                 url,
+		CertificateFingerprint: make([]byte, 32),
+	}
+	err := client.Send(req)
+
+	if !errors.Is(err, ErrCertificateMismatch) {
+		t.Errorf("err = %v, want = %v", err, ErrCertificateMismatch)
+	}
+}
+
+func TestClientVerifiesCertificate(t *testing.T) {
+	s := Server{}
+	url := startTLSServer(t, &s)
+	defer s.Shutdown(context.Background())
+
+	client := Client{}
+	defer client.Close()
+
+	req := Request{
+		Payload: []byte("text"),
+		Remote:  url,
+	}
+
+	if err := client.Send(req); err == nil {
+		t.Errorf("err = %v, want self-signed certificate error", err)
+	}
+}
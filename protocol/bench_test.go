@@ -0,0 +1,101 @@
+package protocol_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Amaimersion/terminal-chat/protocol"
+)
+
+var benchPacket = protocol.Packet{
+	Payload:         []byte(strings.Repeat("a", 1024)),
+	DestinationPort: 1,
+	SourcePort:      2,
+	ListenPort:      4444,
+	MessageID:       3,
+	Timestamp:       time.Unix(1600000000, 0),
+	ContentType:     protocol.ContentTypeText,
+	Checksum:        true,
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := protocol.Marshal(benchPacket); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendMarshal(b *testing.B) {
+	b.ReportAllocs()
+
+	var buf []byte
+
+	for i := 0; i < b.N; i++ {
+		var err error
+
+		if buf, err = protocol.AppendMarshal(buf[:0], benchPacket); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalTo(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if err := protocol.MarshalTo(io.Discard, benchPacket); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	b.ReportAllocs()
+
+	data, _ := protocol.Marshal(benchPacket)
+
+	for i := 0; i < b.N; i++ {
+		if _, err := protocol.Unmarshal(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalFrom(b *testing.B) {
+	b.ReportAllocs()
+
+	data, _ := protocol.Marshal(benchPacket)
+	p := protocol.Packet{}
+
+	for i := 0; i < b.N; i++ {
+		if err := protocol.UnmarshalFrom(data, &p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeTo(b *testing.B) {
+	b.ReportAllocs()
+
+	data, _ := protocol.Marshal(benchPacket)
+	stream := bytes.Repeat(data, 100)
+	r := bytes.NewReader(stream)
+	decoder := protocol.NewDecoder(r)
+	p := protocol.Packet{}
+
+	for i := 0; i < b.N; i++ {
+		if r.Len() == 0 {
+			r.Reset(stream)
+		}
+
+		if err := decoder.DecodeTo(&p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
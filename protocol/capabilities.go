@@ -0,0 +1,75 @@
+package protocol
+
+// Flags describes special purposes of packet.
+type Flags uint8
+
+const (
+	// FlagHello marks packet as request for capabilities.
+	// Receiver should respond with its own packet with
+	// FlagHello using the same connection. Sender of
+	// request should not respond to response.
+	// Such packets have empty payload and should be
+	// not handled as regular packets.
+	FlagHello Flags = 1 << iota
+
+	// FlagCompressed marks payload as DEFLATE compressed.
+	// It is set by Marshal and cleared by Unmarshal, see
+	// Packet.Compress instead. Such packets should be sent
+	// only to peers with CapCompression.
+	FlagCompressed
+
+	// FlagAck marks packet as acknowledgement of message with
+	// MessageID. It is sent back to SourcePort of message
+	// after message has been accepted by application.
+	// Such packets have empty payload and should be
+	// sent only to peers with CapAcks.
+	FlagAck
+
+	// FlagEncrypted marks payload as encrypted by application.
+	// Encryption scheme is not specified by protocol, ContentType
+	// describes decrypted payload, so payload is not validated.
+	// Such packets should be sent only to peers with CapEncryption.
+	FlagEncrypted
+)
+
+// Has reports whether all flags from x are set in f.
+func (f Flags) Has(x Flags) bool {
+	return f&x == x
+}
+
+// Capabilities is a set of optional protocol features
+// that are supported by peer.
+//
+// Sender should use feature only if receiver supports it.
+// Features of receivers that don't tell about their
+// capabilities, like v1 receivers, should be considered
+// as not supported.
+type Capabilities uint16
+
+const (
+	// Payload can be encrypted
+	CapEncryption Capabilities = 1 << iota
+
+	// Packets can be acknowledged
+	CapAcks
+
+	// Payload can be compressed
+	CapCompression
+
+	// Fragmented messages can be reassembled
+	CapFragmentation
+
+	// Payload checksums are verified
+	CapChecksum
+
+	// Ports above MaxNarrowPortValue are understood
+	CapWideLocations
+
+	// Signatures of messages are verified
+	CapSignatures
+)
+
+// Has reports whether all capabilities from x are set in c.
+func (c Capabilities) Has(x Capabilities) bool {
+	return c&x == x
+}
@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+const (
+	// Payloads shorter than that are never compressed,
+	// because gain is too small for them
+	MinCompressLength = 256
+
+	// Maximum length of decompressed payload. Payloads that
+	// exceed it are considered as decompression bombs
+	MaxDecompressedLength = MaxPayloadLength
+)
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// compress returns DEFLATE compressed payload.
+//
+// false will be returned if payload is too short
+// or compression doesn't reduce its length.
+func compress(payload []byte) ([]byte, bool) {
+	if len(payload) < MinCompressLength {
+		return nil, false
+	}
+
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+
+	w.Reset(&buf)
+
+	if _, err := w.Write(payload); err != nil {
+		return nil, false
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, false
+	}
+
+	if buf.Len() >= len(payload) {
+		return nil, false
+	}
+
+	return buf.Bytes(), true
+}
+
+// decompress returns decompressed DEFLATE payload.
+//
+// ErrTooBigPacket will be returned if decompressed payload
+// exceeds MaxDecompressedLength, ErrCorruptedPacket will be
+// returned if payload is not a valid DEFLATE stream.
+func decompress(payload []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(payload))
+	defer r.Close()
+
+	// read one byte more to detect excess
+	limited := io.LimitReader(r, MaxDecompressedLength+1)
+	result, err := io.ReadAll(limited)
+
+	if err != nil {
+		return nil, ErrCorruptedPacket
+	}
+
+	if len(result) > MaxDecompressedLength {
+		return nil, ErrTooBigPacket
+	}
+
+	return result, nil
+}
@@ -0,0 +1,87 @@
+package protocol_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"strings"
+	"testing"
+
+	"github.com/Amaimersion/terminal-chat/protocol"
+)
+
+func TestMarshalCompressed(t *testing.T) {
+	packet := protocol.Packet{
+		Payload:  []byte(strings.Repeat("log line\n", 1000)),
+		Compress: true,
+		Checksum: true,
+	}
+	data, err := protocol.Marshal(packet)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if len(data) >= len(packet.Payload) {
+		t.Errorf("data length = %v, want less than %v", len(data), len(packet.Payload))
+	}
+
+	if flags := protocol.Flags(data[7]); !flags.Has(protocol.FlagCompressed) {
+		t.Errorf("flags = %v, want = %v", flags, protocol.FlagCompressed)
+	}
+
+	result, err := protocol.Unmarshal(data)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if !bytes.Equal(result.Payload, packet.Payload) {
+		t.Errorf("result payload length = %v, want = %v", len(result.Payload), len(packet.Payload))
+	}
+
+	if !result.Compress || result.Flags.Has(protocol.FlagCompressed) {
+		t.Errorf("result compress = %v, flags = %v, want compress without flag", result.Compress, result.Flags)
+	}
+}
+
+func TestMarshalCompressShortPayload(t *testing.T) {
+	packet := protocol.Packet{
+		Payload:  []byte("short"),
+		Compress: true,
+	}
+	data, err := protocol.Marshal(packet)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if flags := protocol.Flags(data[7]); flags.Has(protocol.FlagCompressed) {
+		t.Errorf("flags = %v, want uncompressed", flags)
+	}
+}
+
+func TestUnmarshalDecompressionBomb(t *testing.T) {
+	var payload bytes.Buffer
+	w, _ := flate.NewWriter(&payload, flate.BestCompression)
+	w.Write(make([]byte, protocol.MaxDecompressedLength+1))
+	w.Close()
+
+	data := []byte{0, 0, 10, 0, 0, 0, protocol.CurrentVersion, byte(protocol.FlagCompressed), 0, 0}
+	data[0] = byte(payload.Len() >> 8)
+	data[1] = byte(payload.Len())
+	data = append(data, payload.Bytes()...)
+	_, err := protocol.Unmarshal(data)
+
+	if err != protocol.ErrTooBigPacket {
+		t.Errorf("err = %v, want = %v", err, protocol.ErrTooBigPacket)
+	}
+}
+
+func TestUnmarshalInvalidCompressedPayload(t *testing.T) {
+	data := []byte{0, 3, 10, 0, 0, 0, protocol.CurrentVersion, byte(protocol.FlagCompressed), 0, 0, 0xff, 0xff, 0xff}
+	_, err := protocol.Unmarshal(data)
+
+	if err != protocol.ErrCorruptedPacket {
+		t.Errorf("err = %v, want = %v", err, protocol.ErrCorruptedPacket)
+	}
+}
@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// Common content types of payload.
+const (
+	// UTF-8 text, it is assumed if content type is not specified
+	ContentTypeText = "text/plain"
+
+	// Arbitrary binary data
+	ContentTypeBinary = "application/octet-stream"
+
+	// JSON document
+	ContentTypeJSON = "application/json"
+)
+
+// ErrInvalidText is returned by Marshal, Unmarshal and Reassembler
+// if payload of text content type is not valid UTF-8.
+var ErrInvalidText = errors.New("text payload is not valid UTF-8")
+
+// IsTextContentType reports whether content type describes
+// UTF-8 text. Empty content type is considered as text.
+func IsTextContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+
+	// parameters, like charset, are not relevant
+	if i := strings.IndexByte(contentType, ';'); i != -1 {
+		contentType = contentType[:i]
+	}
+
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+
+	return strings.HasPrefix(contentType, "text/")
+}
+
+// parseContentType converts content type option to string.
+// Common content types don't allocate.
+func parseContentType(v []byte) string {
+	switch string(v) {
+	case ContentTypeText:
+		return ContentTypeText
+	case ContentTypeBinary:
+		return ContentTypeBinary
+	case ContentTypeJSON:
+		return ContentTypeJSON
+	}
+
+	return string(v)
+}
+
+// validatePayload checks that payload matches content type.
+//
+// Payload of fragment is only a part of message, so it can
+// end in the middle of UTF-8 sequence. Such payloads are
+// not checked, reassembled message should be checked instead.
+// Encrypted payloads can't be checked at all.
+func validatePayload(p Packet) error {
+	skip :=
+		!p.Fragment.IsEmpty() ||
+			!p.IsText() ||
+			p.Flags.Has(FlagEncrypted)
+
+	if skip {
+		return nil
+	}
+
+	if !utf8.Valid(p.Payload) {
+		return ErrInvalidText
+	}
+
+	return nil
+}
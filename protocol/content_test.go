@@ -0,0 +1,141 @@
+package protocol_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Amaimersion/terminal-chat/protocol"
+)
+
+func TestIsTextContentType(t *testing.T) {
+	tests := map[string]bool{
+		"":                          true,
+		protocol.ContentTypeText:    true,
+		"text/markdown":             true,
+		"Text/Plain; charset=utf-8": true,
+		protocol.ContentTypeBinary:  false,
+		protocol.ContentTypeJSON:    false,
+	}
+
+	for contentType, want := range tests {
+		if result := protocol.IsTextContentType(contentType); result != want {
+			t.Errorf("%q: result = %v, want = %v", contentType, result, want)
+		}
+	}
+}
+
+func TestMarshalBinaryPayload(t *testing.T) {
+	packet := protocol.Packet{
+		Payload:     []byte{0xff, 0x00, 0xfe},
+		ContentType: protocol.ContentTypeBinary,
+	}
+	data, err := protocol.Marshal(packet)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	result, err := protocol.Unmarshal(data)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if !bytes.Equal(result.Payload, packet.Payload) {
+		t.Errorf("result payload = %v, want = %v", result.Payload, packet.Payload)
+	}
+
+	if result.ContentType != packet.ContentType {
+		t.Errorf("result content type = %v, want = %v", result.ContentType, packet.ContentType)
+	}
+}
+
+func TestMarshalInvalidText(t *testing.T) {
+	packet := protocol.Packet{
+		Payload: []byte{0xff, 0x00, 0xfe},
+	}
+	_, err := protocol.Marshal(packet)
+
+	if err != protocol.ErrInvalidText {
+		t.Errorf("err = %v, want = %v", err, protocol.ErrInvalidText)
+	}
+}
+
+func TestMarshalEncryptedText(t *testing.T) {
+	packet := protocol.Packet{
+		Payload: []byte{0xff, 0x00, 0xfe},
+		Flags:   protocol.FlagEncrypted,
+	}
+	data, err := protocol.Marshal(packet)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	result, err := protocol.Unmarshal(data)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if !result.Flags.Has(protocol.FlagEncrypted) {
+		t.Errorf("result flags = %v, want = %v", result.Flags, protocol.FlagEncrypted)
+	}
+
+	if !bytes.Equal(result.Payload, packet.Payload) {
+		t.Errorf("result payload = %v, want = %v", result.Payload, packet.Payload)
+	}
+}
+
+func TestUnmarshalInvalidText(t *testing.T) {
+	data := []byte{0, 2, 4, 0, 0xc3, 0x28}
+	_, err := protocol.Unmarshal(data)
+
+	if err != protocol.ErrInvalidText {
+		t.Errorf("err = %v, want = %v", err, protocol.ErrInvalidText)
+	}
+}
+
+func TestReassembleMultiByteText(t *testing.T) {
+	// 3 bytes per rune, so fragments will split runes
+	packet := protocol.Packet{
+		Payload:   []byte(strings.Repeat("€", protocol.MaxPayloadLength)),
+		MessageID: 1,
+	}
+	fragments, err := protocol.Split(packet)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	r := protocol.Reassembler{
+		MaxLength: len(packet.Payload),
+	}
+
+	for i, f := range fragments {
+		data, err := protocol.Marshal(f)
+
+		if err != nil {
+			t.Fatalf("err = %v, want = %v", err, nil)
+		}
+
+		if f, err = protocol.Unmarshal(data); err != nil {
+			t.Fatalf("err = %v, want = %v", err, nil)
+		}
+
+		result, ok, err := r.Add(f)
+
+		if err != nil {
+			t.Fatalf("err = %v, want = %v", err, nil)
+		}
+
+		if ok != (i == len(fragments)-1) {
+			t.Fatalf("ok = %v at fragment %v", ok, i)
+		}
+
+		if ok && !bytes.Equal(result.Payload, packet.Payload) {
+			t.Errorf("result payload length = %v, want = %v", len(result.Payload), len(packet.Payload))
+		}
+	}
+}
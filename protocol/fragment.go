@@ -0,0 +1,243 @@
+package protocol
+
+import (
+	"errors"
+	"time"
+)
+
+// Fragment describes position of packet in fragmented message.
+type Fragment struct {
+	// Position of fragment, starting from 0
+	Index uint16
+
+	// Total number of fragments in message,
+	// 0 means that packet is not a fragment
+	Count uint16
+}
+
+// IsEmpty reports whether packet is not a fragment.
+func (f Fragment) IsEmpty() bool {
+	return f.Count == 0
+}
+
+var (
+	// ErrTooBigMessage is returned by Split and Reassembler
+	// if message exceeds its maximum length
+	ErrTooBigMessage = errors.New("message exceeds its maximum length")
+
+	// ErrNoMessageID is returned by Split if message
+	// doesn't have ID that is required for reassembly
+	ErrNoMessageID = errors.New("message ID is not specified")
+
+	// ErrTooManyMessages is returned by Reassembler if
+	// too many messages are being reassembled at once
+	ErrTooManyMessages = errors.New("too many incomplete messages")
+)
+
+const (
+	// Default maximum length of payload of fragmented message
+	DefaultMaxMessageLength = 1024 * 1024
+
+	// Default maximum number of messages that
+	// can be reassembled at once
+	DefaultMaxMessages = 16
+
+	maxFragments = 1<<16 - 1
+)
+
+// Split splits packet into fragments, each of them have payload
+// of at most MaxPayloadLength bytes. All fields of packet are copied
+// into every fragment.
+//
+// If packet fits into single packet, then it is returned as is.
+// Otherwise packet should have MessageID, and ErrNoMessageID will
+// be returned in case if it is missing. ErrTooBigMessage will be
+// returned if packet requires too many fragments. ErrInvalidText
+// will be returned if payload of text content type is not valid UTF-8.
+func Split(p Packet) ([]Packet, error) {
+	if err := validatePayload(p); err != nil {
+		return nil, err
+	}
+
+	if len(p.Payload) <= MaxPayloadLength {
+		return []Packet{p}, nil
+	}
+
+	if p.MessageID == 0 {
+		return nil, ErrNoMessageID
+	}
+
+	count := (len(p.Payload) + MaxPayloadLength - 1) / MaxPayloadLength
+
+	if count > maxFragments {
+		return nil, ErrTooBigMessage
+	}
+
+	result := make([]Packet, 0, count)
+
+	for i := 0; i != count; i++ {
+		start := i * MaxPayloadLength
+		end := start + MaxPayloadLength
+
+		if end > len(p.Payload) {
+			end = len(p.Payload)
+		}
+
+		f := p
+		f.Payload = p.Payload[start:end]
+		f.Fragment = Fragment{
+			Index: uint16(i),
+			Count: uint16(count),
+		}
+		result = append(result, f)
+	}
+
+	return result, nil
+}
+
+// Reassembler reassembles fragmented messages.
+//
+// Fragments are identified by MessageID, so all fragments
+// of different messages should have different IDs. Fragments
+// may arrive in any order.
+//
+// Reassembler is not safe for concurrent use.
+type Reassembler struct {
+	// Maximum length of payload of reassembled message.
+	// Zero means DefaultMaxMessageLength.
+	MaxLength int
+
+	// How long to wait for missing fragments since arrival
+	// of first fragment. Incomplete messages are dropped
+	// silently after that. Zero means no timeout.
+	Timeout time.Duration
+
+	// Maximum number of messages that can be reassembled
+	// at once. Zero means DefaultMaxMessages.
+	MaxMessages int
+
+	messages map[uint64]*partialMessage
+}
+
+type partialMessage struct {
+	fragments []*Packet
+	arrived   int
+	length    int
+	startedAt time.Time
+}
+
+// Add adds packet to reassembly.
+//
+// If packet is not a fragment, then it is returned as is.
+// If packet completes message, then packet with full payload
+// is returned, its fields are taken from first fragment.
+// Otherwise ok is false.
+//
+// ErrTooBigMessage will be returned if message exceeds MaxLength,
+// ErrCorruptedPacket will be returned if fragment is inconsistent
+// with previous fragments, ErrInvalidText will be returned if
+// reassembled text is not valid UTF-8. In all cases message is dropped.
+// ErrTooManyMessages will be returned if MaxMessages is reached,
+// in that case fragment is dropped.
+func (r *Reassembler) Add(p Packet) (result Packet, ok bool, err error) {
+	if p.Fragment.IsEmpty() {
+		return p, true, nil
+	}
+
+	r.expire(time.Now())
+
+	if r.messages == nil {
+		r.messages = make(map[uint64]*partialMessage)
+	}
+
+	maxLength := r.MaxLength
+
+	if maxLength == 0 {
+		maxLength = DefaultMaxMessageLength
+	}
+
+	// All fragments except last one are full,
+	// so number of fragments can be checked in advance.
+	maxCount := (maxLength + MaxPayloadLength - 1) / MaxPayloadLength
+
+	if int(p.Fragment.Count) > maxCount {
+		return Packet{}, false, ErrTooBigMessage
+	}
+
+	id := p.MessageID
+	m, exists := r.messages[id]
+
+	if !exists {
+		maxMessages := r.MaxMessages
+
+		if maxMessages == 0 {
+			maxMessages = DefaultMaxMessages
+		}
+
+		if len(r.messages) >= maxMessages {
+			return Packet{}, false, ErrTooManyMessages
+		}
+
+		m = &partialMessage{
+			fragments: make([]*Packet, p.Fragment.Count),
+			startedAt: time.Now(),
+		}
+		r.messages[id] = m
+	}
+
+	isValid :=
+		id != 0 &&
+			int(p.Fragment.Count) == len(m.fragments) &&
+			p.Fragment.Index < p.Fragment.Count &&
+			m.fragments[p.Fragment.Index] == nil
+
+	if !isValid {
+		delete(r.messages, id)
+		return Packet{}, false, ErrCorruptedPacket
+	}
+
+	m.length += len(p.Payload)
+
+	if m.length > maxLength {
+		delete(r.messages, id)
+		return Packet{}, false, ErrTooBigMessage
+	}
+
+	m.fragments[p.Fragment.Index] = &p
+	m.arrived++
+
+	if m.arrived != len(m.fragments) {
+		return Packet{}, false, nil
+	}
+
+	delete(r.messages, id)
+
+	payload := make([]byte, 0, m.length)
+
+	for _, f := range m.fragments {
+		payload = append(payload, f.Payload...)
+	}
+
+	result = *m.fragments[0]
+	result.Payload = payload
+	result.Fragment = Fragment{}
+
+	if err := validatePayload(result); err != nil {
+		return Packet{}, false, err
+	}
+
+	return result, true, nil
+}
+
+// expire drops incomplete messages that are waiting for too long.
+func (r *Reassembler) expire(now time.Time) {
+	if r.Timeout == 0 {
+		return
+	}
+
+	for id, m := range r.messages {
+		if now.Sub(m.startedAt) > r.Timeout {
+			delete(r.messages, id)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package protocol_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Amaimersion/terminal-chat/protocol"
+)
+
+func TestSplitSmallPacket(t *testing.T) {
+	packet := protocol.Packet{
+		Payload: []byte("test"),
+	}
+	fragments, err := protocol.Split(packet)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if len(fragments) != 1 || !fragments[0].Fragment.IsEmpty() {
+		t.Errorf("fragments = %v, want packet as is", fragments)
+	}
+}
+
+func TestSplitWithoutMessageID(t *testing.T) {
+	packet := protocol.Packet{
+		Payload: []byte(strings.Repeat("a", protocol.MaxPayloadLength+1)),
+	}
+	_, err := protocol.Split(packet)
+
+	if err != protocol.ErrNoMessageID {
+		t.Errorf("err = %v, want = %v", err, protocol.ErrNoMessageID)
+	}
+}
+
+func TestSplitAndReassemble(t *testing.T) {
+	packet := protocol.Packet{
+		Payload:         []byte(strings.Repeat("abc", protocol.MaxPayloadLength)),
+		DestinationPort: 1,
+		SourcePort:      2,
+		MessageID:       3,
+	}
+	fragments, err := protocol.Split(packet)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if l := len(fragments); l != 3 {
+		t.Fatalf("len(fragments) = %v, want = 3", l)
+	}
+
+	r := protocol.Reassembler{}
+
+	// fragments may arrive in any order
+	for _, i := range []int{2, 0} {
+		data, err := protocol.Marshal(fragments[i])
+
+		if err != nil {
+			t.Fatalf("err = %v, want = %v", err, nil)
+		}
+
+		f, err := protocol.Unmarshal(data)
+
+		if err != nil {
+			t.Fatalf("err = %v, want = %v", err, nil)
+		}
+
+		if _, ok, err := r.Add(f); ok || err != nil {
+			t.Fatalf("ok = %v, err = %v, want incomplete message", ok, err)
+		}
+	}
+
+	result, ok, err := r.Add(fragments[1])
+
+	if !ok || err != nil {
+		t.Fatalf("ok = %v, err = %v, want complete message", ok, err)
+	}
+
+	if !bytes.Equal(result.Payload, packet.Payload) {
+		t.Errorf("result payload length = %v, want = %v", len(result.Payload), len(packet.Payload))
+	}
+
+	if result.DestinationPort != packet.DestinationPort || result.SourcePort != packet.SourcePort {
+		t.Errorf("result ports = %v/%v, want = %v/%v", result.SourcePort, result.DestinationPort, packet.SourcePort, packet.DestinationPort)
+	}
+
+	if !result.Fragment.IsEmpty() {
+		t.Errorf("result fragment = %v, want empty", result.Fragment)
+	}
+}
+
+func TestReassembleTooBigMessage(t *testing.T) {
+	packet := protocol.Packet{
+		Payload:   []byte(strings.Repeat("a", protocol.MaxPayloadLength*2)),
+		MessageID: 1,
+	}
+	fragments, _ := protocol.Split(packet)
+	r := protocol.Reassembler{
+		MaxLength: protocol.MaxPayloadLength,
+	}
+	_, _, err := r.Add(fragments[0])
+
+	if err != protocol.ErrTooBigMessage {
+		t.Errorf("err = %v, want = %v", err, protocol.ErrTooBigMessage)
+	}
+}
+
+func TestReassembleDuplicateFragment(t *testing.T) {
+	packet := protocol.Packet{
+		Payload:   []byte(strings.Repeat("a", protocol.MaxPayloadLength*2)),
+		MessageID: 1,
+	}
+	fragments, _ := protocol.Split(packet)
+	r := protocol.Reassembler{}
+	r.Add(fragments[0])
+	_, _, err := r.Add(fragments[0])
+
+	if err != protocol.ErrCorruptedPacket {
+		t.Errorf("err = %v, want = %v", err, protocol.ErrCorruptedPacket)
+	}
+}
+
+func TestReassembleTooManyMessages(t *testing.T) {
+	r := protocol.Reassembler{
+		MaxMessages: 1,
+	}
+
+	for id := uint64(1); id != 3; id++ {
+		packet := protocol.Packet{
+			Payload:   []byte(strings.Repeat("a", protocol.MaxPayloadLength*2)),
+			MessageID: id,
+		}
+		fragments, _ := protocol.Split(packet)
+		_, _, err := r.Add(fragments[0])
+
+		if id == 2 && err != protocol.ErrTooManyMessages {
+			t.Errorf("err = %v, want = %v", err, protocol.ErrTooManyMessages)
+		}
+	}
+}
+
+func TestReassembleTimeout(t *testing.T) {
+	packet := protocol.Packet{
+		Payload:   []byte(strings.Repeat("a", protocol.MaxPayloadLength*2)),
+		MessageID: 1,
+	}
+	fragments, _ := protocol.Split(packet)
+	r := protocol.Reassembler{
+		Timeout: time.Millisecond * 10,
+	}
+	r.Add(fragments[0])
+	time.Sleep(time.Millisecond * 20)
+
+	// first fragment is expired, so message is incomplete
+	if _, ok, err := r.Add(fragments[1]); ok || err != nil {
+		t.Errorf("ok = %v, err = %v, want incomplete message", ok, err)
+	}
+}
@@ -0,0 +1,197 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"time"
+)
+
+// OptionType identifies header option.
+type OptionType uint8
+
+// Known header options.
+const (
+	// Unique ID of message, 8 bytes
+	OptionMessageID OptionType = iota + 1
+
+	// When packet was sent, 8 bytes of Unix time in nanoseconds
+	OptionTimestamp
+
+	// Position of fragment, 2 bytes of index and 2 bytes of count
+	OptionFragment
+
+	// MIME type of payload, ASCII string
+	OptionContentType
+
+	// CRC-32C of payload, 4 bytes
+	OptionChecksum
+
+	// Ports that don't fit into 4 bits, 2 bytes
+	// of source port and 2 bytes of destination port
+	OptionLocations
+
+	// Ed25519 signature of message, 32 bytes of
+	// public key and 64 bytes of signature
+	OptionSignature
+)
+
+// Option is a header extension encoded as type-length-value entry.
+//
+// Known options are represented by separate Packet fields,
+// Option is used only for options that are unknown to this
+// version of protocol.
+type Option struct {
+	Type  OptionType
+	Value []byte
+}
+
+const (
+	optionHeaderLength = 2
+	maxOptionLength    = 255
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// appendOptions encodes options of packet, both known and unknown.
+func appendOptions(dst []byte, p Packet) ([]byte, error) {
+	if p.MessageID != 0 {
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, p.MessageID)
+		dst = appendOption(dst, OptionMessageID, v)
+	}
+
+	if !p.Timestamp.IsZero() {
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(p.Timestamp.UnixNano()))
+		dst = appendOption(dst, OptionTimestamp, v)
+	}
+
+	if !p.Fragment.IsEmpty() {
+		v := make([]byte, 4)
+		binary.BigEndian.PutUint16(v[0:2], p.Fragment.Index)
+		binary.BigEndian.PutUint16(v[2:4], p.Fragment.Count)
+		dst = appendOption(dst, OptionFragment, v)
+	}
+
+	if p.HasWideLocations() {
+		v := make([]byte, 4)
+		binary.BigEndian.PutUint16(v[0:2], p.SourcePort)
+		binary.BigEndian.PutUint16(v[2:4], p.DestinationPort)
+		dst = appendOption(dst, OptionLocations, v)
+	}
+
+	if p.ContentType != "" {
+		if len(p.ContentType) > maxOptionLength {
+			return nil, ErrTooBigPacket
+		}
+
+		dst = append(dst, uint8(OptionContentType), uint8(len(p.ContentType)))
+		dst = append(dst, p.ContentType...)
+	}
+
+	if p.Checksum {
+		v := make([]byte, 4)
+		binary.BigEndian.PutUint32(v, crc32.Checksum(p.Payload, crc32c))
+		dst = appendOption(dst, OptionChecksum, v)
+	}
+
+	if !p.Signature.IsEmpty() {
+		dst = append(dst, uint8(OptionSignature), signatureLength)
+		dst = append(dst, p.Signature.PublicKey[:]...)
+		dst = append(dst, p.Signature.Value[:]...)
+	}
+
+	for _, o := range p.Options {
+		if o.Type == 0 || len(o.Value) > maxOptionLength {
+			return nil, ErrTooBigPacket
+		}
+
+		dst = appendOption(dst, o.Type, o.Value)
+	}
+
+	return dst, nil
+}
+
+func appendOption(dst []byte, t OptionType, v []byte) []byte {
+	dst = append(dst, uint8(t), uint8(len(v)))
+	dst = append(dst, v...)
+
+	return dst
+}
+
+// parseOptions decodes options into packet fields.
+// Unknown options are preserved in Packet.Options.
+//
+// Payload is not known yet, so expected checksum
+// is returned instead of being verified.
+func parseOptions(data []byte, p *Packet) (checksum uint32, err error) {
+	for len(data) != 0 {
+		if len(data) < optionHeaderLength {
+			return 0, ErrCorruptedPacket
+		}
+
+		t := OptionType(data[0])
+		l := int(data[1])
+		data = data[optionHeaderLength:]
+
+		if t == 0 || len(data) < l {
+			return 0, ErrCorruptedPacket
+		}
+
+		v := data[:l]
+		data = data[l:]
+
+		switch t {
+		case OptionMessageID:
+			if l != 8 {
+				return 0, ErrCorruptedPacket
+			}
+
+			p.MessageID = binary.BigEndian.Uint64(v)
+		case OptionTimestamp:
+			if l != 8 {
+				return 0, ErrCorruptedPacket
+			}
+
+			p.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+		case OptionFragment:
+			if l != 4 {
+				return 0, ErrCorruptedPacket
+			}
+
+			p.Fragment.Index = binary.BigEndian.Uint16(v[0:2])
+			p.Fragment.Count = binary.BigEndian.Uint16(v[2:4])
+		case OptionContentType:
+			p.ContentType = parseContentType(v)
+		case OptionChecksum:
+			if l != 4 {
+				return 0, ErrCorruptedPacket
+			}
+
+			p.Checksum = true
+			checksum = binary.BigEndian.Uint32(v)
+		case OptionLocations:
+			if l != 4 {
+				return 0, ErrCorruptedPacket
+			}
+
+			p.SourcePort = binary.BigEndian.Uint16(v[0:2])
+			p.DestinationPort = binary.BigEndian.Uint16(v[2:4])
+		case OptionSignature:
+			if l != signatureLength {
+				return 0, ErrCorruptedPacket
+			}
+
+			copy(p.Signature.PublicKey[:], v)
+			copy(p.Signature.Value[:], v[len(p.Signature.PublicKey):])
+		default:
+			o := Option{
+				Type:  t,
+				Value: append([]byte(nil), v...),
+			}
+			p.Options = append(p.Options, o)
+		}
+	}
+
+	return checksum, nil
+}
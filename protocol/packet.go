@@ -3,108 +3,351 @@ package protocol
 import (
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
+	"io"
 	"math"
+	"sync"
+	"time"
 )
 
 // Packet is a structured representation
 // of both protocol header and payload
 type Packet struct {
-	// UTF-8 text
-	Payload string
+	// Arbitrary data, its format is described by ContentType
+	Payload []byte
 
-	// Destination of packet at application level
-	DestinationPort uint8
+	// MIME type of Payload, like ContentTypeText.
+	// Optional, empty means ContentTypeText
+	ContentType string
+
+	// Destination of packet at application level.
+	// Values above MaxNarrowPortValue require CapWideLocations
+	DestinationPort uint16
 
 	// Source of packet at application level.
-	// Can be used for response by receiver
-	SourcePort uint8
+	// Can be used for response by receiver.
+	// Values above MaxNarrowPortValue require CapWideLocations
+	SourcePort uint16
+
+	// TCP port on which sender listens for incoming packets.
+	// Can be used for response by receiver.
+	// Optional, 0 means that port is not specified
+	ListenPort uint16
+
+	// Version of protocol that was used by sender.
+	// It is set by Unmarshal, Marshal always uses CurrentVersion
+	Version uint8
+
+	// Special purposes of packet
+	Flags Flags
+
+	// Optional features that are supported by sender.
+	// 0 means that sender either doesn't support
+	// any features or doesn't tell about them
+	Capabilities Capabilities
+
+	// Unique ID of message.
+	// Optional, 0 means that ID is not specified
+	MessageID uint64
+
+	// When packet was sent.
+	// Optional, zero time means that time is not specified
+	Timestamp time.Time
+
+	// Position of packet in fragmented message.
+	// Optional, empty means that packet is not a fragment
+	Fragment Fragment
+
+	// Whether checksum of payload is sent along with packet.
+	// Marshal computes checksum and Unmarshal verifies it,
+	// for arrived packets it means that checksum was verified
+	Checksum bool
+
+	// Whether payload should be compressed. Marshal compresses
+	// only payloads that are long enough and become shorter,
+	// Unmarshal decompresses them transparently. For arrived
+	// packets it means that payload was compressed
+	Compress bool
+
+	// Signature of message, see Sign and Verify.
+	// Optional, empty means that message is not signed.
+	// For arrived packets it is not verified by Unmarshal
+	Signature Signature
+
+	// Header options that are unknown to this version
+	// of protocol. They are preserved as is
+	Options []Option
 }
 
 var (
 	// ErrTooBigPacket is returned by Marshal
-	// if passed packet is too big to transmit
+	// if passed packet is too big to transmit,
+	// or by Decoder if arrived packet exceeds limit
 	ErrTooBigPacket = errors.New("packet data exceeds its maximum size or value")
 
 	// ErrCorruptedPacket is returned by Unmarshal
 	// if arrived packet data have invalid structure
 	ErrCorruptedPacket = errors.New("packet data is corrupted")
+
+	// ErrChecksumMismatch is returned by Unmarshal
+	// if checksum of arrived payload doesn't match
+	// checksum that was computed by sender
+	ErrChecksumMismatch = errors.New("packet checksum mismatch")
+)
+
+const (
+	// Version of packets without version field
+	Version1 = 1
+
+	// Version of packets with version, flags and capabilities fields
+	Version2 = 2
+
+	// Version that is used by Marshal
+	CurrentVersion = Version2
 )
 
 const (
 	// Maximum length of Payload
 	MaxPayloadLength = math.MaxUint16
 
+	// Maximum length of header
+	MaxHeaderLength = math.MaxUint8
+
+	// Maximum length of whole packet, including header
+	MaxPacketLength = MaxHeaderLength + MaxPayloadLength
+
 	// Maximum value for DestinationPort or SourcePort
-	MaxPortValue = 15 // max of 4 bits
+	MaxPortValue = math.MaxUint16
 
+	// Maximum value for DestinationPort or SourcePort that
+	// fits into header of peers without CapWideLocations
+	MaxNarrowPortValue = 15 // max of 4 bits
+
+	// v1 header, listen port is optional
 	fixedHeaderLength = 4
-	maxPacketLength   = MaxPayloadLength + fixedHeaderLength
+	listenPortLength  = 2
+
+	// v2 header, all fields are required,
+	// header options follow these fields
+	versionedHeaderLength = 10
 )
 
-// Marshal converts packet to byte stream
+// HasWideLocations reports whether ports of packet don't fit
+// into 4 bits, so they are sent using OptionLocations.
+func (p Packet) HasWideLocations() bool {
+	wide :=
+		p.SourcePort > MaxNarrowPortValue ||
+			p.DestinationPort > MaxNarrowPortValue
+
+	return wide
+}
+
+// IsText reports whether payload is UTF-8 text.
+func (p Packet) IsText() bool {
+	return IsTextContentType(p.ContentType)
+}
+
+// Marshal converts packet to byte stream.
+//
+// ErrInvalidText will be returned if payload of
+// text content type is not valid UTF-8.
 func Marshal(data Packet) ([]byte, error) {
-	payload := []byte(data.Payload)
+	return AppendMarshal(nil, data)
+}
+
+// AppendMarshal is similar to Marshal, but appends packet
+// to dst and returns extended buffer. dst can be reused
+// for multiple packets to avoid allocations.
+//
+// dst is returned unmodified in case of error.
+func AppendMarshal(dst []byte, data Packet) ([]byte, error) {
+	if err := validatePayload(data); err != nil {
+		return dst, err
+	}
+
+	// receiver will not accept more after decompression
+	if len(data.Payload) > MaxPayloadLength {
+		return dst, ErrTooBigPacket
+	}
+
+	flags := data.Flags &^ FlagCompressed
+
+	if data.Compress {
+		if compressed, ok := compress(data.Payload); ok {
+			data.Payload = compressed
+			flags |= FlagCompressed
+		}
+	}
+
+	start := len(dst)
+	packet := append(dst, make([]byte, versionedHeaderLength)...)
+	packet, err := appendOptions(packet, data)
+
+	if err != nil {
+		return dst, err
+	}
+
+	payload := data.Payload
 	payloadLength := len(payload)
-	packetLength := fixedHeaderLength + payloadLength
+	headerLength := len(packet) - start
 
-	if packetLength > maxPacketLength {
-		return nil, ErrTooBigPacket
+	if payloadLength > MaxPayloadLength || headerLength > MaxHeaderLength {
+		return dst, ErrTooBigPacket
 	}
 
-	packet := make([]byte, packetLength)
+	header := packet[start:]
 
-	binary.BigEndian.PutUint16(packet[0:2], uint16(payloadLength))
+	binary.BigEndian.PutUint16(header[0:2], uint16(payloadLength))
 
-	packet[2] = fixedHeaderLength
-	packet[3] = 0
-	packet[3] |= data.SourcePort
-	packet[3] <<= 4
-	packet[3] |= data.DestinationPort
+	header[2] = uint8(headerLength)
+	header[3] = 0
 
-	copy(packet[fixedHeaderLength:], payload)
+	// wide ports are sent using option, so
+	// peers without its support will see 0
+	if !data.HasWideLocations() {
+		header[3] |= uint8(data.SourcePort)
+		header[3] <<= 4
+		header[3] |= uint8(data.DestinationPort)
+	}
+
+	binary.BigEndian.PutUint16(header[4:6], data.ListenPort)
+
+	header[6] = CurrentVersion
+	header[7] = uint8(flags)
+
+	binary.BigEndian.PutUint16(header[8:10], uint16(data.Capabilities))
+
+	packet = append(packet, payload...)
 
 	return packet, nil
 }
 
+var marshalBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 512)
+		return &b
+	},
+}
+
+// MarshalTo is similar to Marshal, but writes packet to w.
+// Packet is written using single Write call. Internal
+// buffers are reused between calls.
+func MarshalTo(w io.Writer, data Packet) error {
+	buf := marshalBuffers.Get().(*[]byte)
+	defer marshalBuffers.Put(buf)
+
+	b, err := AppendMarshal((*buf)[:0], data)
+
+	if err != nil {
+		return err
+	}
+
+	*buf = b
+	_, err = w.Write(b)
+
+	return err
+}
+
 const (
 	destinationPortMask = 0b00001111
 	sourcePortMask      = 0b11110000
 )
 
-// Unmarshal converts byte stream to packet
+// Unmarshal converts byte stream to packet.
+//
+// Packets of newer versions are parsed as packets of
+// CurrentVersion, unknown fields and flags are ignored.
+// ErrInvalidText will be returned if payload of text
+// content type is not valid UTF-8. ErrChecksumMismatch
+// will be returned if payload doesn't match its checksum.
+// Compressed payload is decompressed, ErrTooBigPacket will be
+// returned if it exceeds MaxDecompressedLength.
 func Unmarshal(data []byte) (Packet, error) {
 	packet := Packet{}
 
-	if len(data) < fixedHeaderLength {
-		return packet, ErrCorruptedPacket
+	if err := UnmarshalFrom(data, &packet); err != nil {
+		return Packet{}, err
 	}
 
-	headerLength := int(data[2])
+	return packet, nil
+}
 
-	if len(data) < headerLength {
-		return packet, ErrCorruptedPacket
+// UnmarshalFrom is similar to Unmarshal, but parses data into
+// packet p that is owned by caller. Memory of p.Payload and
+// p.Options is reused, so the same packet can be used for
+// multiple calls to avoid allocations. All other fields of
+// p are overwritten. Result doesn't reference data.
+//
+// p is not valid in case of error.
+func UnmarshalFrom(data []byte, p *Packet) error {
+	*p = Packet{
+		Payload: p.Payload[:0],
+		Options: p.Options[:0],
 	}
 
-	var payload []byte
+	if len(data) < fixedHeaderLength {
+		return ErrCorruptedPacket
+	}
 
-	if len(data) == headerLength {
-		payload = make([]byte, 0)
-	} else {
-		payload = data[headerLength:]
+	headerLength := int(data[2])
+
+	if len(data) < headerLength || headerLength < fixedHeaderLength {
+		return ErrCorruptedPacket
 	}
 
+	payload := data[headerLength:]
 	payloadLength := int(binary.BigEndian.Uint16(data[:2]))
 
 	if len(payload) != payloadLength {
-		return packet, ErrCorruptedPacket
+		return ErrCorruptedPacket
 	}
 
-	destinationPort := uint8(data[3] & destinationPortMask)
-	sourcePort := uint8((data[3] & sourcePortMask) >> 4)
+	p.DestinationPort = uint16(data[3] & destinationPortMask)
+	p.SourcePort = uint16((data[3] & sourcePortMask) >> 4)
 
-	packet.Payload = string(payload)
-	packet.DestinationPort = destinationPort
-	packet.SourcePort = sourcePort
+	// optional fields, older senders may not specify them
+	if headerLength >= fixedHeaderLength+listenPortLength {
+		p.ListenPort = binary.BigEndian.Uint16(data[4:6])
+	}
 
-	return packet, nil
+	p.Version = Version1
+
+	var checksum uint32
+
+	if headerLength >= versionedHeaderLength {
+		p.Version = data[6]
+		p.Flags = Flags(data[7])
+		p.Capabilities = Capabilities(binary.BigEndian.Uint16(data[8:10]))
+
+		if p.Version < Version2 {
+			return ErrCorruptedPacket
+		}
+
+		options := data[versionedHeaderLength:headerLength]
+
+		var err error
+
+		if checksum, err = parseOptions(options, p); err != nil {
+			return err
+		}
+	}
+
+	if p.Checksum && crc32.Checksum(payload, crc32c) != checksum {
+		return ErrChecksumMismatch
+	}
+
+	if p.Flags.Has(FlagCompressed) {
+		var err error
+
+		if payload, err = decompress(payload); err != nil {
+			return err
+		}
+
+		p.Flags &^= FlagCompressed
+		p.Compress = true
+	}
+
+	p.Payload = append(p.Payload, payload...)
+
+	return validatePayload(*p)
 }
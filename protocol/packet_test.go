@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/Amaimersion/terminal-chat/protocol"
 )
@@ -11,7 +12,7 @@ import (
 func TestMarshalPacket(t *testing.T) {
 	payload := "test"
 	packet := protocol.Packet{
-		Payload:         payload,
+		Payload:         []byte(payload),
 		DestinationPort: 0b100,
 		SourcePort:      0b10,
 	}
@@ -19,8 +20,12 @@ func TestMarshalPacket(t *testing.T) {
 	expectedData := []byte{
 		0,
 		byte(len(payload)),
-		4,
+		10,
 		0b00100100,
+		0, 0,
+		protocol.CurrentVersion,
+		0,
+		0, 0,
 	}
 	expectedData = append(expectedData, []byte(payload)...)
 
@@ -36,7 +41,7 @@ func TestMarshalPacket(t *testing.T) {
 func TestMarshalMaxSizePacket(t *testing.T) {
 	payload := strings.Repeat("a", protocol.MaxPayloadLength)
 	packet := protocol.Packet{
-		Payload:         payload,
+		Payload:         []byte(payload),
 		DestinationPort: 0,
 		SourcePort:      0,
 	}
@@ -44,8 +49,12 @@ func TestMarshalMaxSizePacket(t *testing.T) {
 	expectedData := []byte{
 		255,
 		255,
-		4,
+		10,
+		0,
+		0, 0,
+		protocol.CurrentVersion,
 		0,
+		0, 0,
 	}
 	expectedData = append(expectedData, []byte(payload)...)
 
@@ -63,7 +72,7 @@ func TestMarshalMaxSizePacket(t *testing.T) {
 func TestMarshalTooBigPacket(t *testing.T) {
 	payload := strings.Repeat("a", protocol.MaxPayloadLength+1)
 	packet := protocol.Packet{
-		Payload: payload,
+		Payload: []byte(payload),
 	}
 	_, err := protocol.Marshal(packet)
 
@@ -74,12 +83,12 @@ func TestMarshalTooBigPacket(t *testing.T) {
 
 func TestMarshalEmptyPayload(t *testing.T) {
 	packet := protocol.Packet{
-		Payload:         "",
+		Payload:         nil,
 		DestinationPort: 0,
 		SourcePort:      0,
 	}
 	data, err := protocol.Marshal(packet)
-	expectedData := []byte{0, 0, 4, 0}
+	expectedData := []byte{0, 0, 10, 0, 0, 0, protocol.CurrentVersion, 0, 0, 0}
 
 	if err != nil {
 		t.Fatalf("err = %v, want = %v", err, nil)
@@ -92,18 +101,18 @@ func TestMarshalEmptyPayload(t *testing.T) {
 
 func TestUnmarshalStream(t *testing.T) {
 	expectedPacket := protocol.Packet{
-		Payload:         "test",
+		Payload:         []byte("test"),
 		DestinationPort: 8,
 		SourcePort:      2,
 	}
 	secondByte := byte(len(expectedPacket.Payload))
 
 	var fourthByte byte = 0
-	fourthByte |= expectedPacket.SourcePort
+	fourthByte |= byte(expectedPacket.SourcePort)
 	fourthByte <<= 4
-	fourthByte |= expectedPacket.DestinationPort
+	fourthByte |= byte(expectedPacket.DestinationPort)
 
-	payload := []byte(expectedPacket.Payload)
+	payload := expectedPacket.Payload
 	data := []byte{0, secondByte, 4, fourthByte}
 	data = append(data, payload...)
 	resultPacket, err := protocol.Unmarshal(data)
@@ -112,7 +121,7 @@ func TestUnmarshalStream(t *testing.T) {
 		t.Fatalf("err = %v, want = %v", err, nil)
 	}
 
-	if resultPacket.Payload != expectedPacket.Payload {
+	if !bytes.Equal(resultPacket.Payload, expectedPacket.Payload) {
 		t.Errorf("result payload = %v, want = %v", resultPacket.Payload, expectedPacket.Payload)
 	}
 
@@ -163,7 +172,7 @@ func TestUnmarshalInvalidPayloadLength(t *testing.T) {
 
 func TestUnmarshalEmptyPayload(t *testing.T) {
 	expectedPacket := protocol.Packet{
-		Payload: "",
+		Payload: nil,
 	}
 	data := []byte{0, 0, 4, 0}
 	resultPacket, err := protocol.Unmarshal(data)
@@ -172,16 +181,16 @@ func TestUnmarshalEmptyPayload(t *testing.T) {
 		t.Fatalf("err = %v, want = %v", err, nil)
 	}
 
-	if resultPacket.Payload != expectedPacket.Payload {
+	if !bytes.Equal(resultPacket.Payload, expectedPacket.Payload) {
 		t.Errorf("result payload = %v, want = %v", resultPacket.Payload, expectedPacket.Payload)
 	}
 }
 
 func TestUnmarshalBigPayload(t *testing.T) {
 	expectedPacket := protocol.Packet{
-		Payload: strings.Repeat("a", 256),
+		Payload: []byte(strings.Repeat("a", 256)),
 	}
-	payload := []byte(expectedPacket.Payload)
+	payload := expectedPacket.Payload
 	data := []byte{1, 0, 4, 0}
 	data = append(data, payload...)
 	resultPacket, err := protocol.Unmarshal(data)
@@ -190,7 +199,309 @@ func TestUnmarshalBigPayload(t *testing.T) {
 		t.Fatalf("err = %v, want = %v", err, nil)
 	}
 
-	if resultPacket.Payload != expectedPacket.Payload {
+	if !bytes.Equal(resultPacket.Payload, expectedPacket.Payload) {
 		t.Errorf("result payload = %v, want = %v", resultPacket.Payload, expectedPacket.Payload)
 	}
 }
+
+func TestMarshalListenPort(t *testing.T) {
+	packet := protocol.Packet{
+		Payload:         []byte("a"),
+		DestinationPort: 1,
+		SourcePort:      2,
+		ListenPort:      4444,
+	}
+	data, err := protocol.Marshal(packet)
+	expectedData := []byte{0, 1, 10, 0b00100001, 0x11, 0x5c, protocol.CurrentVersion, 0, 0, 0, 'a'}
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if !bytes.Equal(data, expectedData) {
+		t.Errorf("result data = %v, want = %v", data, expectedData)
+	}
+}
+
+func TestUnmarshalListenPort(t *testing.T) {
+	data := []byte{0, 1, 6, 0, 0x11, 0x5c, 'a'}
+	packet, err := protocol.Unmarshal(data)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	var want uint16 = 4444
+
+	if packet.ListenPort != want {
+		t.Errorf("result listen port = %v, want = %v", packet.ListenPort, want)
+	}
+
+	if string(packet.Payload) != "a" {
+		t.Errorf("result payload = %v, want = %v", packet.Payload, "a")
+	}
+}
+
+func TestUnmarshalWithoutListenPort(t *testing.T) {
+	data := []byte{0, 1, 4, 0, 'a'}
+	packet, err := protocol.Unmarshal(data)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if packet.ListenPort != 0 {
+		t.Errorf("result listen port = %v, want = %v", packet.ListenPort, 0)
+	}
+}
+
+func TestMarshalVersionFields(t *testing.T) {
+	packet := protocol.Packet{
+		Flags:        protocol.FlagHello,
+		Capabilities: protocol.CapAcks | protocol.CapCompression,
+	}
+	data, err := protocol.Marshal(packet)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	result, err := protocol.Unmarshal(data)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if result.Version != protocol.CurrentVersion {
+		t.Errorf("result version = %v, want = %v", result.Version, protocol.CurrentVersion)
+	}
+
+	if result.Flags != packet.Flags {
+		t.Errorf("result flags = %v, want = %v", result.Flags, packet.Flags)
+	}
+
+	if result.Capabilities != packet.Capabilities {
+		t.Errorf("result capabilities = %v, want = %v", result.Capabilities, packet.Capabilities)
+	}
+}
+
+func TestUnmarshalVersion1(t *testing.T) {
+	data := []byte{0, 1, 4, 0, 'a'}
+	packet, err := protocol.Unmarshal(data)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if packet.Version != protocol.Version1 {
+		t.Errorf("result version = %v, want = %v", packet.Version, protocol.Version1)
+	}
+
+	if packet.Capabilities != 0 {
+		t.Errorf("result capabilities = %v, want = %v", packet.Capabilities, 0)
+	}
+}
+
+func TestUnmarshalInvalidVersion(t *testing.T) {
+	data := []byte{0, 0, 10, 0, 0, 0, 0, 0, 0, 0}
+	_, err := protocol.Unmarshal(data)
+
+	if err != protocol.ErrCorruptedPacket {
+		t.Errorf("err = %v, want = %v", err, protocol.ErrCorruptedPacket)
+	}
+}
+
+func TestUnmarshalNewerVersion(t *testing.T) {
+	data := []byte{0, 1, 12, 0, 0, 0, protocol.CurrentVersion + 1, 0, 0, 0, 200, 0, 'a'}
+	packet, err := protocol.Unmarshal(data)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if string(packet.Payload) != "a" {
+		t.Errorf("result payload = %v, want = %v", packet.Payload, "a")
+	}
+}
+
+func TestMarshalOptions(t *testing.T) {
+	packet := protocol.Packet{
+		Payload:   []byte("test"),
+		MessageID: 0x0102030405060708,
+		Timestamp: time.Unix(1600000000, 123),
+		Options: []protocol.Option{
+			{Type: 200, Value: []byte{1, 2, 3}},
+			{Type: 201, Value: []byte{}},
+		},
+	}
+	data, err := protocol.Marshal(packet)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	wantOptions := []byte{
+		byte(protocol.OptionMessageID), 8, 1, 2, 3, 4, 5, 6, 7, 8,
+		byte(protocol.OptionTimestamp), 8,
+	}
+
+	if !bytes.Equal(data[10:10+len(wantOptions)], wantOptions) {
+		t.Errorf("result options = %v, want prefix = %v", data[10:], wantOptions)
+	}
+
+	result, err := protocol.Unmarshal(data)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if !bytes.Equal(result.Payload, packet.Payload) {
+		t.Errorf("result payload = %v, want = %v", result.Payload, packet.Payload)
+	}
+
+	if result.MessageID != packet.MessageID {
+		t.Errorf("result message ID = %v, want = %v", result.MessageID, packet.MessageID)
+	}
+
+	if !result.Timestamp.Equal(packet.Timestamp) {
+		t.Errorf("result timestamp = %v, want = %v", result.Timestamp, packet.Timestamp)
+	}
+
+	if len(result.Options) != len(packet.Options) {
+		t.Fatalf("len(options) = %v, want = %v", len(result.Options), len(packet.Options))
+	}
+
+	for i, o := range result.Options {
+		want := packet.Options[i]
+
+		if o.Type != want.Type || !bytes.Equal(o.Value, want.Value) {
+			t.Errorf("result option = %v, want = %v", o, want)
+		}
+	}
+}
+
+func TestMarshalTooBigOptions(t *testing.T) {
+	packet := protocol.Packet{
+		Options: []protocol.Option{
+			{Type: 200, Value: make([]byte, 200)},
+			{Type: 201, Value: make([]byte, 200)},
+		},
+	}
+	_, err := protocol.Marshal(packet)
+
+	if err != protocol.ErrTooBigPacket {
+		t.Errorf("err = %v, want = %v", err, protocol.ErrTooBigPacket)
+	}
+}
+
+func TestUnmarshalCorruptedOptions(t *testing.T) {
+	streams := [][]byte{
+		// option without length
+		{0, 0, 11, 0, 0, 0, protocol.CurrentVersion, 0, 0, 0, 200},
+		// option value is longer than header
+		{0, 0, 12, 0, 0, 0, protocol.CurrentVersion, 0, 0, 0, 200, 5},
+		// known option with invalid length
+		{0, 0, 13, 0, 0, 0, protocol.CurrentVersion, 0, 0, 0, byte(protocol.OptionMessageID), 1, 1},
+		// zero option type
+		{0, 0, 12, 0, 0, 0, protocol.CurrentVersion, 0, 0, 0, 0, 0},
+	}
+
+	for _, data := range streams {
+		_, err := protocol.Unmarshal(data)
+
+		if err != protocol.ErrCorruptedPacket {
+			t.Errorf("%v: err = %v, want = %v", data, err, protocol.ErrCorruptedPacket)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	packet := protocol.Packet{
+		Payload:  []byte("test"),
+		Checksum: true,
+	}
+	data, err := protocol.Marshal(packet)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	result, err := protocol.Unmarshal(data)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if !result.Checksum {
+		t.Errorf("result checksum = %v, want = %v", result.Checksum, true)
+	}
+
+	// flip single bit of payload
+	data[len(data)-1] ^= 1
+	_, err = protocol.Unmarshal(data)
+
+	if err != protocol.ErrChecksumMismatch {
+		t.Errorf("err = %v, want = %v", err, protocol.ErrChecksumMismatch)
+	}
+}
+
+func TestWithoutChecksum(t *testing.T) {
+	packet := protocol.Packet{
+		Payload: []byte("test"),
+	}
+	data, _ := protocol.Marshal(packet)
+	result, err := protocol.Unmarshal(data)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if result.Checksum {
+		t.Errorf("result checksum = %v, want = %v", result.Checksum, false)
+	}
+}
+
+func TestMarshalWideLocations(t *testing.T) {
+	packet := protocol.Packet{
+		Payload:         []byte("test"),
+		SourcePort:      300,
+		DestinationPort: 2,
+	}
+	data, err := protocol.Marshal(packet)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	// peers without wide locations should not
+	// deliver packet to wrong location
+	if data[3] != 0 {
+		t.Errorf("narrow ports = %v, want = 0", data[3])
+	}
+
+	result, err := protocol.Unmarshal(data)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if result.SourcePort != packet.SourcePort || result.DestinationPort != packet.DestinationPort {
+		t.Errorf("result ports = %v/%v, want = %v/%v", result.SourcePort, result.DestinationPort, packet.SourcePort, packet.DestinationPort)
+	}
+}
+
+func TestMarshalNarrowLocations(t *testing.T) {
+	packet := protocol.Packet{
+		SourcePort:      protocol.MaxNarrowPortValue,
+		DestinationPort: 1,
+	}
+	data, _ := protocol.Marshal(packet)
+
+	if headerLength := data[2]; headerLength != 10 {
+		t.Errorf("header length = %v, want = 10", headerLength)
+	}
+
+	if data[3] != 0xf1 {
+		t.Errorf("narrow ports = %v, want = %v", data[3], 0xf1)
+	}
+}
@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+)
+
+// Signature is an Ed25519 signature of message
+// along with public key of signer.
+type Signature struct {
+	// Public key of signer
+	PublicKey [ed25519.PublicKeySize]byte
+
+	// Signature of message, see Packet.Sign
+	Value [ed25519.SignatureSize]byte
+}
+
+// ErrInvalidSignature is returned if signature
+// of arrived message can't be verified
+var ErrInvalidSignature = errors.New("packet signature is invalid")
+
+const (
+	signatureLength = ed25519.PublicKeySize + ed25519.SignatureSize
+
+	// prevents reuse of signatures from other protocols
+	signatureContext = "STTP signature v1"
+)
+
+// IsEmpty reports whether message is not signed.
+func (s Signature) IsEmpty() bool {
+	return s == Signature{}
+}
+
+// Sign signs message with key. Signature covers payload, content
+// type, message ID, timestamp, ports, listen port, capabilities
+// and flags except FlagCompressed, so all of them should be set
+// before signing.
+//
+// Message should be signed before Split, so every fragment
+// carries signature of whole message. Signature is sent
+// using OptionSignature.
+func (p *Packet) Sign(key ed25519.PrivateKey) {
+	copy(p.Signature.PublicKey[:], key.Public().(ed25519.PublicKey))
+	copy(p.Signature.Value[:], ed25519.Sign(key, signedData(*p)))
+}
+
+// Verify reports whether message has valid signature.
+//
+// Fragments can't be verified, only reassembled
+// message can be verified.
+func (p Packet) Verify() bool {
+	if p.Signature.IsEmpty() || !p.Fragment.IsEmpty() {
+		return false
+	}
+
+	key := ed25519.PublicKey(p.Signature.PublicKey[:])
+
+	return ed25519.Verify(key, signedData(p), p.Signature.Value[:])
+}
+
+// signedData returns bytes of message that are covered by signature.
+func signedData(p Packet) []byte {
+	data := make([]byte, 0, len(signatureContext)+32+len(p.ContentType)+len(p.Payload))
+	data = append(data, signatureContext...)
+
+	var fields [27]byte
+	binary.BigEndian.PutUint16(fields[0:2], p.SourcePort)
+	binary.BigEndian.PutUint16(fields[2:4], p.DestinationPort)
+	binary.BigEndian.PutUint16(fields[4:6], p.ListenPort)
+	binary.BigEndian.PutUint16(fields[6:8], uint16(p.Capabilities))
+	binary.BigEndian.PutUint64(fields[8:16], p.MessageID)
+
+	if !p.Timestamp.IsZero() {
+		binary.BigEndian.PutUint64(fields[16:24], uint64(p.Timestamp.UnixNano()))
+	}
+
+	// compression is not a part of message
+	fields[24] = uint8(p.Flags &^ FlagCompressed)
+	binary.BigEndian.PutUint16(fields[25:27], uint16(len(p.ContentType)))
+
+	data = append(data, fields[:]...)
+	data = append(data, p.ContentType...)
+	data = append(data, p.Payload...)
+
+	return data
+}
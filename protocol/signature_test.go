@@ -0,0 +1,121 @@
+package protocol_test
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Amaimersion/terminal-chat/protocol"
+)
+
+func newSignedPacket(t *testing.T) (protocol.Packet, ed25519.PublicKey) {
+	public, private, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	packet := protocol.Packet{
+		Payload:         []byte(strings.Repeat("text", 100)),
+		ContentType:     protocol.ContentTypeText,
+		DestinationPort: 300,
+		SourcePort:      2,
+		ListenPort:      4444,
+		Flags:           protocol.FlagEncrypted,
+		MessageID:       5,
+		Timestamp:       time.Unix(1600000000, 123),
+		Compress:        true,
+	}
+	packet.Sign(private)
+
+	return packet, public
+}
+
+func TestSignAndVerify(t *testing.T) {
+	packet, public := newSignedPacket(t)
+	data, err := protocol.Marshal(packet)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	result, err := protocol.Unmarshal(data)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if !result.Verify() {
+		t.Errorf("verify = %v, want = %v", false, true)
+	}
+
+	if key := result.Signature.PublicKey; string(key[:]) != string(public) {
+		t.Errorf("public key = %v, want = %v", key, public)
+	}
+}
+
+func TestVerifyModified(t *testing.T) {
+	packet, _ := newSignedPacket(t)
+	modifications := []func(p *protocol.Packet){
+		func(p *protocol.Packet) { p.Payload = []byte("other") },
+		func(p *protocol.Packet) { p.DestinationPort = 301 },
+		func(p *protocol.Packet) { p.MessageID = 6 },
+		func(p *protocol.Packet) { p.Flags |= protocol.FlagAck },
+		func(p *protocol.Packet) { p.Signature.Value[0] ^= 1 },
+	}
+
+	for i, modify := range modifications {
+		p := packet
+		modify(&p)
+
+		if p.Verify() {
+			t.Errorf("%v: verify = %v, want = %v", i, true, false)
+		}
+	}
+
+	if (protocol.Packet{}).Verify() {
+		t.Errorf("unsigned: verify = %v, want = %v", true, false)
+	}
+}
+
+func TestVerifyReassembled(t *testing.T) {
+	packet, _ := newSignedPacket(t)
+	packet.Payload = []byte(strings.Repeat("abc", protocol.MaxPayloadLength))
+	packet.Sign(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	fragments, err := protocol.Split(packet)
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	r := protocol.Reassembler{
+		MaxLength: len(packet.Payload),
+	}
+
+	for _, f := range fragments {
+		data, err := protocol.Marshal(f)
+
+		if err != nil {
+			t.Fatalf("err = %v, want = %v", err, nil)
+		}
+
+		if f, err = protocol.Unmarshal(data); err != nil {
+			t.Fatalf("err = %v, want = %v", err, nil)
+		}
+
+		if f.Verify() {
+			t.Errorf("fragment: verify = %v, want = %v", true, false)
+		}
+
+		result, ok, err := r.Add(f)
+
+		if err != nil {
+			t.Fatalf("err = %v, want = %v", err, nil)
+		}
+
+		if ok && !result.Verify() {
+			t.Errorf("verify = %v, want = %v", false, true)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Decoder reads and decodes packets from an input stream.
+//
+// Packets are framed using payload length and header length
+// fields, so any number of packets can be read from single
+// stream without waiting for its end.
+type Decoder struct {
+	// Maximum length of single packet, including header.
+	// Packets that exceed it will be not read at all.
+	// Zero means MaxPacketLength.
+	MaxLength int
+
+	r   io.Reader
+	buf []byte
+}
+
+// NewDecoder returns a new decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	d := &Decoder{
+		r: r,
+	}
+
+	return d
+}
+
+// Buffer sets initial buffer that is used to read packets.
+// Buffer grows as needed, it is reused for all packets.
+// It should be called before first Decode.
+func (d *Decoder) Buffer(buf []byte) {
+	d.buf = buf
+}
+
+// Decode reads next packet from stream.
+//
+// io.EOF will be returned if stream ends before
+// first byte of packet. io.ErrUnexpectedEOF will
+// be returned if stream ends in the middle of packet.
+// ErrCorruptedPacket will be returned if packet data
+// have invalid structure. ErrTooBigPacket will be returned
+// if packet exceeds MaxLength.
+func (d *Decoder) Decode() (Packet, error) {
+	p := Packet{}
+
+	if err := d.DecodeTo(&p); err != nil {
+		return Packet{}, err
+	}
+
+	return p, nil
+}
+
+// DecodeTo is similar to Decode, but reads next packet
+// into p that is owned by caller, see UnmarshalFrom.
+//
+// p is not valid in case of error.
+func (d *Decoder) DecodeTo(p *Packet) error {
+	if cap(d.buf) < fixedHeaderLength {
+		d.buf = make([]byte, 0, MaxHeaderLength)
+	}
+
+	header := d.buf[:fixedHeaderLength]
+
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		return err
+	}
+
+	payloadLength := int(binary.BigEndian.Uint16(header[0:2]))
+	headerLength := int(header[2])
+
+	if headerLength < fixedHeaderLength {
+		return ErrCorruptedPacket
+	}
+
+	maxLength := d.MaxLength
+
+	if maxLength == 0 {
+		maxLength = MaxPacketLength
+	}
+
+	if headerLength+payloadLength > maxLength {
+		return ErrTooBigPacket
+	}
+
+	length := headerLength + payloadLength
+
+	if cap(d.buf) < length {
+		buf := make([]byte, length)
+		copy(buf, header)
+		d.buf = buf
+	}
+
+	data := d.buf[:length]
+
+	if _, err := io.ReadFull(d.r, data[fixedHeaderLength:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return err
+	}
+
+	return UnmarshalFrom(data, p)
+}
+
+// Encoder encodes and writes packets to an output stream.
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	e := &Encoder{
+		w: w,
+	}
+
+	return e
+}
+
+// Encode writes packet to stream.
+//
+// ErrTooBigPacket will be returned before writing
+// if packet is too big to transmit.
+func (e *Encoder) Encode(p Packet) error {
+	return MarshalTo(e.w, p)
+}
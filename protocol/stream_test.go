@@ -0,0 +1,106 @@
+package protocol_test
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/Amaimersion/terminal-chat/protocol"
+)
+
+func TestDecodeMultiplePackets(t *testing.T) {
+	packets := []protocol.Packet{
+		{
+			Payload:         []byte("first"),
+			DestinationPort: 1,
+			SourcePort:      2,
+		},
+		{
+			Payload:         nil,
+			DestinationPort: 3,
+			SourcePort:      4,
+		},
+		{
+			Payload:         []byte("third"),
+			DestinationPort: 5,
+			SourcePort:      6,
+			MessageID:       7,
+			Options: []protocol.Option{
+				{Type: 200, Value: []byte{8}},
+			},
+		},
+	}
+	var stream bytes.Buffer
+	encoder := protocol.NewEncoder(&stream)
+
+	for _, p := range packets {
+		if err := encoder.Encode(p); err != nil {
+			t.Fatalf("err = %v, want = %v", err, nil)
+		}
+	}
+
+	decoder := protocol.NewDecoder(&stream)
+
+	for _, want := range packets {
+		want.Version = protocol.CurrentVersion
+		p, err := decoder.Decode()
+
+		if err != nil {
+			t.Fatalf("err = %v, want = %v", err, nil)
+		}
+
+		if !reflect.DeepEqual(p, want) {
+			t.Errorf("result packet = %v, want = %v", p, want)
+		}
+	}
+
+	if _, err := decoder.Decode(); err != io.EOF {
+		t.Errorf("err = %v, want = %v", err, io.EOF)
+	}
+}
+
+func TestDecodeExtraHeaderBytes(t *testing.T) {
+	data := []byte{0, 2, 6, 0b00010010, 9, 9, 'h', 'i'}
+	decoder := protocol.NewDecoder(bytes.NewReader(data))
+	p, err := decoder.Decode()
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if string(p.Payload) != "hi" {
+		t.Errorf("result payload = %v, want = %v", p.Payload, "hi")
+	}
+}
+
+func TestDecodeTruncatedPacket(t *testing.T) {
+	data := []byte{0, 5, 4, 0, 1, 2}
+	decoder := protocol.NewDecoder(bytes.NewReader(data))
+	_, err := decoder.Decode()
+
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("err = %v, want = %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestDecodeInvalidHeaderLength(t *testing.T) {
+	data := []byte{0, 0, 3, 0}
+	decoder := protocol.NewDecoder(bytes.NewReader(data))
+	_, err := decoder.Decode()
+
+	if err != protocol.ErrCorruptedPacket {
+		t.Errorf("err = %v, want = %v", err, protocol.ErrCorruptedPacket)
+	}
+}
+
+func TestDecodeTooBigPacket(t *testing.T) {
+	data := []byte{0, 5, 4, 0, 1, 2, 3, 4, 5}
+	decoder := protocol.NewDecoder(bytes.NewReader(data))
+	decoder.MaxLength = 8
+	_, err := decoder.Decode()
+
+	if err != protocol.ErrTooBigPacket {
+		t.Errorf("err = %v, want = %v", err, protocol.ErrTooBigPacket)
+	}
+}
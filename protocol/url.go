@@ -3,6 +3,7 @@ package protocol
 import (
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"strconv"
 	"strings"
@@ -10,25 +11,44 @@ import (
 
 // URL implements protocol URL scheme.
 //
-// Format: sttp://<IP address>:<TCP port>/<STTP location>
+// Format: sttp://<IP address or host name>:<TCP port>/<STTP location>
+//
+// sttps scheme means the same, but connection
+// should be protected with TLS: sttps://1.2.3.4:4444/0
+//
+// IPv6 address should be enclosed in square brackets and
+// may have zone: sttp://[fe80::1%eth0]:4444/0
+//
+// Host name is kept as is, it should be resolved into
+// IP address by user of URL when needed.
 //
 // It is mostly based on RFC 1738, not RFC 3986
 type URL struct {
-	// IP address
+	// IP address, nil if URL have host name
 	Address net.IP
 
+	// Host name in lower case, empty if URL have IP address
+	Host string
+
+	// IPv6 zone, empty for IPv4 or for IPv6 without zone
+	Zone string
+
 	// TCP port
 	Port uint16
 
 	// STTP location
-	Location uint8
+	Location uint16
+
+	// Whether connection should be protected with TLS
+	Secure bool
 }
 
 // IsEmpty indicates if struct is empty due to
 // missing initialization of required fields.
 func (u URL) IsEmpty() bool {
 	isEmpty :=
-		u.Address == nil
+		u.Address == nil &&
+			u.Host == ""
 
 	return isEmpty
 }
@@ -37,95 +57,336 @@ func (u URL) IsEmpty() bool {
 func (u URL) IsEqual(x URL) bool {
 	eq :=
 		u.Address.Equal(x.Address) &&
+			u.Host == x.Host &&
+			u.Zone == x.Zone &&
 			u.Port == x.Port &&
-			u.Location == x.Location
+			u.Location == x.Location &&
+			u.Secure == x.Secure
 
 	return eq
 }
 
-// IsEqual reports whether u and x are the same URL according to their IP.
+// IsEqualIP reports whether u and x are the same URL according to their IP
+// or host name. IPv6 zone is not compared. Host name is not resolved.
 func (u URL) IsEqualIP(x URL) bool {
 	eq :=
-		u.Address.Equal(x.Address)
+		u.Address.Equal(x.Address) &&
+			u.Host == x.Host
 
 	return eq
 }
 
 // String returns full URL as string
 func (u URL) String() string {
+	sch := scheme
+
+	if u.Secure {
+		sch = secureScheme
+	}
+
 	result := fmt.Sprintf(
-		"sttp://%v:%v/%v",
-		u.Address.String(),
-		u.Port,
+		"%v://%v/%v",
+		sch,
+		u.StringTCPIP(),
 		u.Location,
 	)
 
 	return result
 }
 
-// StringTCPIP returns TCP/IP URL as string
+// StringTCPIP returns TCP/IP URL as string.
+// IPv6 address is enclosed in square brackets.
 func (u URL) StringTCPIP() string {
-	result := fmt.Sprintf(
-		"%v:%v",
-		u.Address.String(),
-		u.Port,
-	)
+	host := u.Host
+
+	if len(host) == 0 {
+		host = u.Address.String()
+	}
+
+	if u.Zone != "" {
+		host += "%" + u.Zone
+	}
+
+	port := strconv.Itoa(int(u.Port))
+	result := net.JoinHostPort(host, port)
 
 	return result
 }
 
 // ErrInvalidURL is returned in case if
-// URL argument have invalid format
+// URL argument have invalid format.
+//
+// Actual error is always *URLError, which
+// matches ErrInvalidURL using errors.Is
 var ErrInvalidURL = errors.New("url have invalid format")
 
+// Components of URL that can be invalid.
+// They are used as URLError.Err
+var (
+	ErrInvalidScheme   = errors.New("invalid URL scheme")
+	ErrInvalidHost     = errors.New("invalid URL host")
+	ErrInvalidPort     = errors.New("invalid URL port")
+	ErrInvalidLocation = errors.New("invalid URL location")
+	ErrInvalidPath     = errors.New("invalid URL path")
+)
+
+// URLError describes which component of URL is invalid and why.
+type URLError struct {
+	// Which component is invalid, one of ErrInvalid* values
+	Err error
+
+	// Value of invalid component
+	Value string
+
+	// Human readable reason
+	Reason string
+}
+
+func (e *URLError) Error() string {
+	m := fmt.Sprintf(
+		"%v %q: %v",
+		e.Err.Error(),
+		e.Value,
+		e.Reason,
+	)
+
+	return m
+}
+
+func (e *URLError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes URLError to match ErrInvalidURL
+func (e *URLError) Is(target error) bool {
+	return target == ErrInvalidURL
+}
+
 const (
+	scheme       = "sttp"
+	secureScheme = "sttps"
+
 	defaultPort     uint16 = 4444
-	defaultLocation uint8  = 0
+	defaultLocation uint16 = 0
 )
 
-// FromString initializes fields from string URL
+// FromString initializes fields from string URL.
+//
+// Scheme, TCP port and location are optional,
+// URL without scheme is not secure.
+// Every component is validated strictly, *URLError
+// will be returned in case of invalid component.
+// u is not modified in case of error.
 func (u *URL) FromString(s string) error {
-	s = strings.ToLower(s)
-	s = strings.TrimPrefix(s, "sttp://")
-	parts := strings.Split(s, "/")
+	secure := false
+
+	if i := strings.Index(s, "://"); i != -1 {
+		sch := s[:i]
+		secure = strings.EqualFold(sch, secureScheme)
+
+		if !secure && !strings.EqualFold(sch, scheme) {
+			return &URLError{ErrInvalidScheme, sch, "only " + scheme + " and " + secureScheme + " are supported"}
+		}
+
+		s = s[i+len("://"):]
+	}
+
+	authority, path := s, ""
 	location := defaultLocation
 
-	if l := len(parts); l > 2 {
-		return ErrInvalidURL
-	} else if l == 2 {
-		parsedLocation, err := strconv.Atoi(parts[1])
+	if i := strings.Index(s, "/"); i != -1 {
+		authority, path = s[:i], s[i+1:]
+	}
+
+	if i := strings.Index(path, "/"); i != -1 {
+		return &URLError{ErrInvalidPath, path[i:], "only location is allowed in path"}
+	}
+
+	if len(path) != 0 || strings.HasSuffix(s, "/") {
+		n, reason := parseDecimal(path, 0, MaxPortValue)
 
-		if err != nil {
-			return ErrInvalidURL
+		if len(reason) != 0 {
+			return &URLError{ErrInvalidLocation, path, reason}
 		}
 
-		location = uint8(parsedLocation)
+		location = uint16(n)
+	}
+
+	host, portPart, err := splitHostPort(authority)
+
+	if err != nil {
+		return err
 	}
 
-	tcpIP := strings.Split(parts[0], ":")
 	port := defaultPort
 
-	if l := len(tcpIP); l > 2 {
-		return ErrInvalidURL
-	} else if l == 2 {
-		parsedPort, err := strconv.Atoi(tcpIP[1])
+	if portPart != nil {
+		n, reason := parseDecimal(*portPart, 1, math.MaxUint16)
 
-		if err != nil {
-			return ErrInvalidURL
+		if len(reason) != 0 {
+			return &URLError{ErrInvalidPort, *portPart, reason}
 		}
 
-		port = uint16(parsedPort)
+		port = uint16(n)
 	}
 
-	address := net.ParseIP(tcpIP[0])
+	zone := ""
+
+	if i := strings.LastIndex(host, "%"); i != -1 {
+		zone = host[i+1:]
+		host = host[:i]
+
+		if len(zone) == 0 {
+			return &URLError{ErrInvalidHost, host + "%", "zone is empty"}
+		}
+	}
+
+	address := net.ParseIP(host)
+	hostName := ""
 
 	if address == nil {
-		return ErrInvalidURL
+		if !isHostName(host) {
+			return &URLError{ErrInvalidHost, host, "not an IP address nor a host name"}
+		}
+
+		if isNumericHostName(host) {
+			return &URLError{ErrInvalidHost, host, "invalid IPv4 address"}
+		}
+
+		if len(zone) != 0 {
+			return &URLError{ErrInvalidHost, host + "%" + zone, "zone is allowed only for IPv6"}
+		}
+
+		hostName = strings.ToLower(host)
+	} else if address.To4() != nil && len(zone) != 0 {
+		return &URLError{ErrInvalidHost, host + "%" + zone, "zone is allowed only for IPv6"}
 	}
 
 	u.Address = address
+	u.Host = hostName
+	u.Zone = zone
 	u.Port = port
 	u.Location = location
+	u.Secure = secure
 
 	return nil
 }
+
+// parseDecimal parses s as decimal number that should be
+// in range from min to max. Only digits are allowed.
+// Non empty reason will be returned if s is invalid.
+func parseDecimal(s string, min, max uint64) (n uint64, reason string) {
+	if len(s) == 0 {
+		return 0, "value is empty"
+	}
+
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return 0, "only digits are allowed"
+		}
+	}
+
+	n, err := strconv.ParseUint(s, 10, 64)
+
+	if err != nil || n < min || n > max {
+		return 0, fmt.Sprintf("value is out of range %v-%v", min, max)
+	}
+
+	return n, ""
+}
+
+// splitHostPort splits "host:port", "[host]:port", "host" or "[host]"
+// into host and port. Port will be nil if it is missing.
+//
+// Unlike net.SplitHostPort, port is optional. Only IPv6 is
+// allowed in square brackets.
+func splitHostPort(s string) (host string, port *string, err error) {
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+
+		if end == -1 {
+			return "", nil, &URLError{ErrInvalidHost, s, "missing closing bracket"}
+		}
+
+		host = s[1:end]
+		rest := s[end+1:]
+		ip := host
+
+		if i := strings.LastIndex(ip, "%"); i != -1 {
+			ip = ip[:i]
+		}
+
+		if parsed := net.ParseIP(ip); parsed == nil || parsed.To4() != nil {
+			return "", nil, &URLError{ErrInvalidHost, s[:end+1], "only IPv6 is allowed in brackets"}
+		}
+
+		if len(rest) == 0 {
+			return host, nil, nil
+		}
+
+		if !strings.HasPrefix(rest, ":") {
+			return "", nil, &URLError{ErrInvalidHost, s, "unexpected data after closing bracket"}
+		}
+
+		rest = rest[1:]
+
+		return host, &rest, nil
+	}
+
+	parts := strings.Split(s, ":")
+
+	if l := len(parts); l > 2 {
+		return "", nil, &URLError{ErrInvalidHost, s, "IPv6 should be enclosed in brackets"}
+	} else if l == 2 {
+		return parts[0], &parts[1], nil
+	}
+
+	return parts[0], nil, nil
+}
+
+// isHostName reports whether s is a valid host name
+// according to RFC 1123.
+func isHostName(s string) bool {
+	if len(s) == 0 || len(s) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(s, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, c := range label {
+			isValid :=
+				(c >= 'a' && c <= 'z') ||
+					(c >= 'A' && c <= 'Z') ||
+					(c >= '0' && c <= '9') ||
+					c == '-'
+
+			if !isValid {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// isNumericHostName reports whether last label of host name s
+// consists only of digits. Top-level domains are never numeric,
+// so such host name is most likely a mistyped IPv4 address.
+func isNumericHostName(s string) bool {
+	label := s[strings.LastIndex(s, ".")+1:]
+
+	for _, c := range label {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -1,6 +1,8 @@
 package protocol_test
 
 import (
+	"errors"
+	"net"
 	"testing"
 
 	"github.com/Amaimersion/terminal-chat/protocol"
@@ -109,7 +111,7 @@ func TestUrlFromString(t *testing.T) {
 
 	wantAddress := []byte{0, 0, 0, 0}
 	var wantPort uint16 = 3333
-	var wantLocation uint8 = 12
+	var wantLocation uint16 = 12
 
 	if !url.Address.Equal(wantAddress) {
 		t.Errorf("address = %v, want = %v", url.Address, wantAddress)
@@ -134,7 +136,7 @@ func TestUrlFromStringWithoutScheme(t *testing.T) {
 
 	wantAddress := []byte{0, 0, 0, 0}
 	var wantPort uint16 = 3333
-	var wantLocation uint8 = 12
+	var wantLocation uint16 = 12
 
 	if !url.Address.Equal(wantAddress) {
 		t.Errorf("address = %v, want = %v", url.Address, wantAddress)
@@ -159,7 +161,7 @@ func TestUrlFromStringWithDefaults(t *testing.T) {
 
 	wantAddress := []byte{1, 2, 3, 4}
 	var wantPort uint16 = 4444
-	var wantLocation uint8 = 0
+	var wantLocation uint16 = 0
 
 	if !url.Address.Equal(wantAddress) {
 		t.Errorf("address = %v, want = %v", url.Address, wantAddress)
@@ -193,3 +195,255 @@ func TestIsEmptyWithRequiredFields(t *testing.T) {
 		t.Error("expected false, got true")
 	}
 }
+
+func TestUrlStringIPv6(t *testing.T) {
+	url := protocol.URL{
+		Address:  net.ParseIP("fe80::1"),
+		Zone:     "eth0",
+		Port:     4444,
+		Location: 1,
+	}
+	s := url.String()
+	want := "sttp://[fe80::1%eth0]:4444/1"
+
+	if s != want {
+		t.Errorf("result = %v, want = %v", s, want)
+	}
+}
+
+func TestUrlFromStringIPv6(t *testing.T) {
+	url := protocol.URL{}
+	err := url.FromString("sttp://[fe80::1%eth0]:3333/12")
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	wantAddress := net.ParseIP("fe80::1")
+	wantZone := "eth0"
+	var wantPort uint16 = 3333
+	var wantLocation uint16 = 12
+
+	if !url.Address.Equal(wantAddress) {
+		t.Errorf("address = %v, want = %v", url.Address, wantAddress)
+	}
+
+	if url.Zone != wantZone {
+		t.Errorf("zone = %v, want = %v", url.Zone, wantZone)
+	}
+
+	if url.Port != wantPort {
+		t.Errorf("port = %v, want = %v", url.Port, wantPort)
+	}
+
+	if url.Location != wantLocation {
+		t.Errorf("location = %v, want = %v", url.Location, wantLocation)
+	}
+}
+
+func TestUrlFromStringIPv6WithDefaults(t *testing.T) {
+	url := protocol.URL{}
+	err := url.FromString("[2001:db8::1]")
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if s, want := url.String(), "sttp://[2001:db8::1]:4444/0"; s != want {
+		t.Errorf("result = %v, want = %v", s, want)
+	}
+}
+
+func TestUrlFromStringInvalidIPv6(t *testing.T) {
+	urls := []string{
+		"sttp://fe80::1:4444/0",
+		"sttp://[fe80::1:4444/0",
+		"sttp://[fe80::1]4444/0",
+		"sttp://1.2.3.4%eth0:4444/0",
+	}
+
+	for _, s := range urls {
+		url := protocol.URL{}
+		err := url.FromString(s)
+
+		if !errors.Is(err, protocol.ErrInvalidHost) {
+			t.Errorf("%v: err = %v, want = %v", s, err, protocol.ErrInvalidHost)
+		}
+	}
+}
+
+func TestUrlFromStringHostName(t *testing.T) {
+	url := protocol.URL{}
+	err := url.FromString("sttp://Bob-Laptop.local:3333/2")
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	wantHost := "bob-laptop.local"
+
+	if url.Address != nil {
+		t.Errorf("address = %v, want = nil", url.Address)
+	}
+
+	if url.Host != wantHost {
+		t.Errorf("host = %v, want = %v", url.Host, wantHost)
+	}
+
+	if url.IsEmpty() {
+		t.Errorf("url is empty, but should be not empty")
+	}
+
+	if s, want := url.String(), "sttp://bob-laptop.local:3333/2"; s != want {
+		t.Errorf("result = %v, want = %v", s, want)
+	}
+}
+
+func TestUrlFromStringWideLocation(t *testing.T) {
+	url := protocol.URL{}
+	err := url.FromString("sttp://1.2.3.4:3333/65535")
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	var wantLocation uint16 = 65535
+
+	if url.Location != wantLocation {
+		t.Errorf("location = %v, want = %v", url.Location, wantLocation)
+	}
+}
+
+func TestUrlFromStringSecure(t *testing.T) {
+	url := protocol.URL{}
+	err := url.FromString("STTPS://1.2.3.4:3333/2")
+
+	if err != nil {
+		t.Fatalf("err = %v, want = %v", err, nil)
+	}
+
+	if !url.Secure {
+		t.Errorf("secure = %v, want = %v", url.Secure, true)
+	}
+
+	if s, want := url.String(), "sttps://1.2.3.4:3333/2"; s != want {
+		t.Errorf("result = %v, want = %v", s, want)
+	}
+
+	plain := url
+	plain.Secure = false
+
+	if url.IsEqual(plain) {
+		t.Errorf("secure url is equal to plain url, but should be not equal")
+	}
+}
+
+func TestUrlFromStringInvalidIPv4(t *testing.T) {
+	urls := []string{
+		"sttp://1.2.3.400:4444/0",
+		"sttp://999.1.1.1:1/1",
+		"sttp://1.2.3:4444/0",
+		"sttp://1234:4444/0",
+		"sttp://bob.123:4444/0",
+	}
+
+	for _, s := range urls {
+		url := protocol.URL{}
+		err := url.FromString(s)
+		urlErr := &protocol.URLError{}
+
+		if !errors.As(err, &urlErr) || urlErr.Err != protocol.ErrInvalidHost || urlErr.Reason != "invalid IPv4 address" {
+			t.Errorf("%v: err = %v, want = %v invalid IPv4 address", s, err, protocol.ErrInvalidHost)
+		}
+	}
+}
+
+func TestUrlFromStringInvalidHostName(t *testing.T) {
+	urls := []string{
+		"sttp://bob_laptop:4444/0",
+		"sttp://-bob:4444/0",
+		"sttp://bob..local:4444/0",
+		"sttp://bob%eth0:4444/0",
+	}
+
+	for _, s := range urls {
+		url := protocol.URL{}
+		err := url.FromString(s)
+
+		if !errors.Is(err, protocol.ErrInvalidHost) {
+			t.Errorf("%v: err = %v, want = %v", s, err, protocol.ErrInvalidHost)
+		}
+	}
+}
+
+func TestUrlFromStringInvalidComponents(t *testing.T) {
+	urls := []struct {
+		s    string
+		want error
+	}{
+		{"http://1.2.3.4:4444/0", protocol.ErrInvalidScheme},
+		{"sttp://1.2.3.4:70000/0", protocol.ErrInvalidPort},
+		{"sttp://1.2.3.4:0/0", protocol.ErrInvalidPort},
+		{"sttp://1.2.3.4:-1/0", protocol.ErrInvalidPort},
+		{"sttp://1.2.3.4:/0", protocol.ErrInvalidPort},
+		{"sttp://1.2.3.4:4444/65536", protocol.ErrInvalidLocation},
+		{"sttp://1.2.3.4:4444/99999999999999999999", protocol.ErrInvalidLocation},
+		{"sttp://1.2.3.4:4444/", protocol.ErrInvalidLocation},
+		{"sttp://1.2.3.4:4444/1?x=1", protocol.ErrInvalidLocation},
+		{"sttp://1.2.3.4:4444/1 ", protocol.ErrInvalidLocation},
+		{"sttp://1.2.3.4:4444/1/2", protocol.ErrInvalidPath},
+		{"sttp://[1.2.3.4]:4444/0", protocol.ErrInvalidHost},
+		{"sttp://:4444/0", protocol.ErrInvalidHost},
+	}
+
+	for _, u := range urls {
+		url := protocol.URL{}
+		err := url.FromString(u.s)
+
+		if !errors.Is(err, u.want) {
+			t.Errorf("%v: err = %v, want = %v", u.s, err, u.want)
+		}
+
+		if !errors.Is(err, protocol.ErrInvalidURL) {
+			t.Errorf("%v: err = %v, want to match %v", u.s, err, protocol.ErrInvalidURL)
+		}
+
+		var urlErr *protocol.URLError
+
+		if !errors.As(err, &urlErr) {
+			t.Errorf("%v: err = %T, want = %T", u.s, err, urlErr)
+		}
+	}
+}
+
+func TestUrlFromStringPortRange(t *testing.T) {
+	for _, port := range []string{"0", "70000"} {
+		url := protocol.URL{}
+		err := url.FromString("sttp://1.2.3.4:" + port + "/0")
+
+		var urlErr *protocol.URLError
+
+		if !errors.As(err, &urlErr) {
+			t.Fatalf("%v: err = %T, want = %T", port, err, urlErr)
+		}
+
+		if want := "value is out of range 1-65535"; urlErr.Reason != want {
+			t.Errorf("%v: reason = %v, want = %v", port, urlErr.Reason, want)
+		}
+	}
+}
+
+func TestUrlFromStringKeepsURLOnError(t *testing.T) {
+	url := protocol.URL{
+		Address: []byte{1, 2, 3, 4},
+	}
+	want := url
+
+	if err := url.FromString("sttp://5.6.7.8:70000"); err == nil {
+		t.Fatalf("err = nil, want some error")
+	}
+
+	if !url.IsEqual(want) {
+		t.Errorf("url = %v, want = %v", url, want)
+	}
+}